@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"unicode/utf16"
+
+	"github.com/gotk3/gotk3/gdk"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// Clipboard format for copying between GoATPAD windows: the selection
+// as a JSON document
+const clipNative = "application/x-goatpad-document"
+
+// Rich formats read on paste, most faithful first
+var clipRichTargets = []string{clipNative, "text/rtf", "text/richtext", "application/rtf", "text/html"}
+
+// Take over copy, cut and paste in the text view so formatting travels
+// with the text, and add Paste as Plain Text (Ctrl+Shift+V) to the
+// context menu.
+func setupClipboard(ed *Editor) {
+	clipboard, err := gtk.ClipboardGet(gdk.SELECTION_CLIPBOARD)
+	if err != nil {
+		log.Fatal("Unable to get clipboard:", err)
+	}
+	ed.textView.Connect("copy-clipboard", func(tv *gtk.TextView) {
+		// The merge preview has a buffer of its own; GTK copies that as text
+		if buf, err := tv.GetBuffer(); err != nil || buf.Native() != ed.buffer.Native() {
+			return
+		}
+		copySelection(ed, clipboard)
+		tv.StopEmission("copy-clipboard")
+	})
+	ed.textView.Connect("cut-clipboard", func(tv *gtk.TextView) {
+		if copySelection(ed, clipboard) && tv.GetEditable() {
+			// Not interactive, so merge field chips go too
+			ed.buffer.DeleteSelection(false, true)
+		}
+		tv.StopEmission("cut-clipboard")
+	})
+	ed.textView.Connect("paste-clipboard", func(tv *gtk.TextView) {
+		pasteClipboard(ed, clipboard, false)
+		tv.StopEmission("paste-clipboard")
+	})
+	ed.textView.Connect("key-press-event", func(tv *gtk.TextView, ev *gdk.Event) bool {
+		key := gdk.EventKeyNewFromEvent(ev)
+		mods := key.State() & uint(gdk.CONTROL_MASK|gdk.SHIFT_MASK)
+		if mods == uint(gdk.CONTROL_MASK|gdk.SHIFT_MASK) && (key.KeyVal() == gdk.KEY_V || key.KeyVal() == gdk.KEY_v) {
+			pasteClipboard(ed, clipboard, true)
+			return true
+		}
+		return false
+	})
+	ed.textView.Connect("populate-popup", func(tv *gtk.TextView, menu *gtk.Menu) {
+		item, err := gtk.MenuItemNewWithLabel("Paste as Plain Text")
+		if err != nil {
+			log.Println("Create menu item error:", err)
+			return
+		}
+		item.SetSensitive(tv.GetEditable() && clipboard.WaitIsTextAvailable())
+		item.Connect("activate", func() {
+			pasteClipboard(ed, clipboard, true)
+		})
+		item.Show()
+		menu.Append(item)
+	})
+}
+
+// Offer the selection as GoATPAD, RTF, HTML and plain text. Returns false
+// when nothing is selected.
+func copySelection(ed *Editor, clipboard *gtk.Clipboard) bool {
+	start, end, ok := ed.buffer.GetSelectionBounds()
+	if !ok {
+		return false
+	}
+	sel := ed.Document().Slice(start.GetOffset(), end.GetOffset())
+	native, err := json.Marshal(sel)
+	if err != nil {
+		log.Println("Copy error:", err)
+		return false
+	}
+	rtf := documentRTF(sel)
+	ok = setClipboard(clipboard, []clipTarget{
+		{clipNative, string(native)},
+		{"text/rtf", rtf},
+		{"text/richtext", rtf},
+		{"application/rtf", rtf},
+		{"text/html", documentHTML(sel)},
+		{"UTF8_STRING", sel.Text},
+		{"text/plain;charset=utf-8", sel.Text},
+		{"text/plain", sel.Text},
+		{"STRING", sel.Text},
+		{"TEXT", sel.Text},
+	})
+	if !ok {
+		log.Println("Copy error: clipboard refused the selection")
+	}
+	return ok
+}
+
+// Replace the selection with the clipboard contents, keeping formatting
+// from the richest format on offer unless plain is set
+func pasteClipboard(ed *Editor, clipboard *gtk.Clipboard, plain bool) {
+	if !ed.textView.GetEditable() {
+		return
+	}
+	var doc *Document
+	if !plain {
+		doc = clipboardDocument(clipboard)
+	}
+	if doc == nil {
+		text, err := clipboard.WaitForText()
+		if err != nil {
+			return
+		}
+		doc = &Document{Text: text}
+	}
+	ed.buffer.DeleteSelection(true, true)
+	ed.InsertDocument(ed.buffer.GetIterAtMark(ed.buffer.GetInsert()).GetOffset(), doc)
+	ed.textView.ScrollMarkOnscreen(ed.buffer.GetInsert())
+}
+
+// Parse the first rich format on the clipboard, or nil if there is none
+func clipboardDocument(clipboard *gtk.Clipboard) *Document {
+	for _, target := range clipRichTargets {
+		atom := gdk.GdkAtomIntern(target, false)
+		if !clipboard.WaitIsTargetAvailable(atom) {
+			continue
+		}
+		sel, err := clipboard.WaitForContents(atom)
+		if err != nil {
+			continue
+		}
+		data := sel.GetData()
+		switch target {
+		case clipNative:
+			doc := &Document{}
+			if err := json.Unmarshal(data, doc); err != nil {
+				log.Println("Paste error:", err)
+				continue
+			}
+			return doc
+		case "text/html":
+			return parseHTML(clipboardString(data))
+		default:
+			return parseRTF(string(data))
+		}
+	}
+	return nil
+}
+
+// Some browsers put HTML on the clipboard as UTF-16
+func clipboardString(data []byte) string {
+	if len(data) >= 2 && data[0] == 0xFF && data[1] == 0xFE {
+		units := make([]uint16, 0, len(data)/2)
+		for i := 2; i+1 < len(data); i += 2 {
+			units = append(units, uint16(data[i])|uint16(data[i+1])<<8)
+		}
+		return string(utf16.Decode(units))
+	}
+	return string(data)
+}
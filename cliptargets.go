@@ -0,0 +1,86 @@
+package main
+
+// gotk3 only offers plain text on the clipboard, so offering several
+// formats at once goes through gtk_clipboard_set_with_data directly.
+
+// #cgo pkg-config: gtk+-3.0
+// #include <gtk/gtk.h>
+// #include <stdlib.h>
+// #include <string.h>
+//
+// typedef struct {
+// 	int n;
+// 	char **targets;
+// 	char **data;
+// } clipData;
+//
+// static void clip_get(GtkClipboard *clipboard, GtkSelectionData *sel, guint info, gpointer user) {
+// 	clipData *cd = user;
+// 	if ((int)info >= cd->n) {
+// 		return;
+// 	}
+// 	if (strncmp(cd->targets[info], "text/plain", 10) == 0 || strcmp(cd->targets[info], "UTF8_STRING") == 0 ||
+// 	    strcmp(cd->targets[info], "STRING") == 0 || strcmp(cd->targets[info], "TEXT") == 0) {
+// 		gtk_selection_data_set_text(sel, cd->data[info], -1);
+// 		return;
+// 	}
+// 	gtk_selection_data_set(sel, gtk_selection_data_get_target(sel), 8,
+// 		(const guchar *)cd->data[info], strlen(cd->data[info]));
+// }
+//
+// static void clip_clear(GtkClipboard *clipboard, gpointer user) {
+// 	clipData *cd = user;
+// 	for (int i = 0; i < cd->n; i++) {
+// 		free(cd->targets[i]);
+// 		free(cd->data[i]);
+// 	}
+// 	free(cd->targets);
+// 	free(cd->data);
+// 	free(cd);
+// }
+//
+// // Takes ownership of targets, data and their strings
+// static gboolean clip_set(void *clipboard, int n, char **targets, char **data) {
+// 	clipData *cd = malloc(sizeof(clipData));
+// 	cd->n = n;
+// 	cd->targets = targets;
+// 	cd->data = data;
+// 	GtkTargetEntry *entries = g_new0(GtkTargetEntry, n);
+// 	for (int i = 0; i < n; i++) {
+// 		entries[i].target = targets[i];
+// 		entries[i].info = i;
+// 	}
+// 	gboolean ok = gtk_clipboard_set_with_data(GTK_CLIPBOARD(clipboard), entries, n, clip_get, clip_clear, cd);
+// 	g_free(entries);
+// 	if (!ok) {
+// 		clip_clear(NULL, cd);
+// 	}
+// 	return ok;
+// }
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// A clipboard format and the data offered for it
+type clipTarget struct {
+	target string
+	data   string
+}
+
+// Put targets on the clipboard, most preferred first. GTK hands out the
+// data on request until something else is copied.
+func setClipboard(clipboard *gtk.Clipboard, targets []clipTarget) bool {
+	n := len(targets)
+	size := C.size_t(unsafe.Sizeof((*C.char)(nil)))
+	names := unsafe.Slice((**C.char)(C.malloc(C.size_t(n)*size)), n)
+	data := unsafe.Slice((**C.char)(C.malloc(C.size_t(n)*size)), n)
+	for i, t := range targets {
+		names[i] = C.CString(t.target)
+		data[i] = C.CString(t.data)
+	}
+	return C.clip_set(unsafe.Pointer(clipboard.GObject), C.int(n), &names[0], &data[0]) != 0
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gotk3/gotk3/glib"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// Comments keeps the comment threads of the document. A thread's range is
+// held by a pair of text marks so it follows edits around it; the side
+// panel lists every thread.
+type Comments struct {
+	window  *gtk.Window
+	buffer  *gtk.TextBuffer
+	tag     *gtk.TextTag
+	panel   *gtk.Box
+	threads map[int]*Comment
+	nextID  int
+	author  func() string
+}
+
+func newComments(window *gtk.Window, buffer *gtk.TextBuffer, tagTable *gtk.TextTagTable, panel *gtk.Box, author func() string) *Comments {
+	tag, err := gtk.TextTagNew("comment")
+	if err != nil {
+		log.Fatal("Unable to create tag:", err)
+	}
+	tag.SetProperty("background", "#FFF3A0")
+	tagTable.Add(tag)
+	return &Comments{
+		window:  window,
+		buffer:  buffer,
+		tag:     tag,
+		panel:   panel,
+		threads: map[int]*Comment{},
+		nextID:  1,
+		author:  author,
+	}
+}
+
+func commentMarkNames(id int) (start, end string) {
+	return fmt.Sprintf("comment-%d-start", id), fmt.Sprintf("comment-%d-end", id)
+}
+
+// Add a thread on start..end
+func (c *Comments) Add(start, end int, text string) {
+	c.add(&Comment{ID: c.nextID, Author: c.author(), Time: time.Now(), Text: text, Start: start, End: end})
+	c.Refresh()
+}
+
+func (c *Comments) add(comment *Comment) {
+	startName, endName := commentMarkNames(comment.ID)
+	// The range neither grows when typing at its edges nor loses them
+	c.buffer.CreateMark(startName, c.buffer.GetIterAtOffset(comment.Start), false)
+	c.buffer.CreateMark(endName, c.buffer.GetIterAtOffset(comment.End), true)
+	c.threads[comment.ID] = comment
+	if comment.ID >= c.nextID {
+		c.nextID = comment.ID + 1
+	}
+}
+
+// Current character range of a thread
+func (c *Comments) bounds(id int) (start, end *gtk.TextIter) {
+	startName, endName := commentMarkNames(id)
+	return c.buffer.GetIterAtMark(c.buffer.GetMark(startName)), c.buffer.GetIterAtMark(c.buffer.GetMark(endName))
+}
+
+func (c *Comments) Delete(id int) {
+	startName, endName := commentMarkNames(id)
+	c.buffer.DeleteMarkByName(startName)
+	c.buffer.DeleteMarkByName(endName)
+	delete(c.threads, id)
+	c.Refresh()
+}
+
+// Comments returns the threads with their current extents, ordered by
+// position.
+func (c *Comments) Comments() []Comment {
+	out := make([]Comment, 0, len(c.threads))
+	for id, thread := range c.threads {
+		cm := *thread
+		start, end := c.bounds(id)
+		cm.Start, cm.End = start.GetOffset(), end.GetOffset()
+		out = append(out, cm)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Start != out[j].Start {
+			return out[i].Start < out[j].Start
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Restore re-creates the threads of a loaded document
+func (c *Comments) Restore(comments []Comment) {
+	for i := range comments {
+		cm := comments[i]
+		c.add(&cm)
+	}
+	c.Refresh()
+}
+
+// Reset drops every thread without touching the text
+func (c *Comments) Reset() {
+	for id := range c.threads {
+		startName, endName := commentMarkNames(id)
+		c.buffer.DeleteMarkByName(startName)
+		c.buffer.DeleteMarkByName(endName)
+	}
+	c.threads = map[int]*Comment{}
+	c.nextID = 1
+	c.Refresh()
+}
+
+// Refresh re-applies the highlight and rebuilds the side panel
+func (c *Comments) Refresh() {
+	bufStart, bufEnd := c.buffer.GetBounds()
+	c.buffer.RemoveTag(c.tag, bufStart, bufEnd)
+	for id, thread := range c.threads {
+		if !thread.Resolved {
+			start, end := c.bounds(id)
+			c.buffer.ApplyTag(c.tag, start, end)
+		}
+	}
+
+	if children := c.panel.GetChildren(); children != nil {
+		children.Foreach(func(item interface{}) {
+			item.(*gtk.Widget).Destroy()
+		})
+	}
+	for _, cm := range c.Comments() {
+		c.panel.PackStart(c.threadWidget(cm), false, false, 5)
+	}
+	c.panel.ShowAll()
+}
+
+// Side panel entry for one thread
+func (c *Comments) threadWidget(cm Comment) gtk.IWidget {
+	frame, err := gtk.FrameNew(fmt.Sprintf("%s, %s", cm.Author, cm.Time.Format("2006-01-02 15:04")))
+	if err != nil {
+		log.Fatal("Unable to create frame:", err)
+	}
+	if cm.Resolved {
+		frame.SetOpacity(0.5)
+	}
+	box, err := gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 2)
+	if err != nil {
+		log.Fatal("Unable to create box:", err)
+	}
+	frame.Add(box)
+
+	// Quoted text; clicking it selects the range in the editor
+	start, end := c.bounds(cm.ID)
+	quote := strings.ReplaceAll(start.GetText(end), "\n", " ")
+	if utf8.RuneCountInString(quote) > 30 {
+		quote = string([]rune(quote)[:30]) + "..."
+	}
+	quoteBtn, err := gtk.ButtonNewWithLabel("“" + quote + "”")
+	if err != nil {
+		log.Fatal("Unable to create button:", err)
+	}
+	quoteBtn.SetRelief(gtk.RELIEF_NONE)
+	quoteBtn.Connect("clicked", func() {
+		start, end := c.bounds(cm.ID)
+		c.buffer.SelectRange(start, end)
+	})
+	box.PackStart(quoteBtn, false, false, 0)
+
+	addLabel := func(text string) {
+		label, err := gtk.LabelNew(text)
+		if err != nil {
+			log.Fatal("Unable to create label:", err)
+		}
+		label.SetLineWrap(true)
+		label.SetXAlign(0)
+		label.SetSelectable(true)
+		box.PackStart(label, false, false, 2)
+	}
+	addLabel(cm.Text)
+	for _, r := range cm.Replies {
+		addLabel(fmt.Sprintf("%s (%s): %s", r.Author, r.Time.Format("2006-01-02 15:04"), r.Text))
+	}
+
+	buttons, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 2)
+	if err != nil {
+		log.Fatal("Unable to create box:", err)
+	}
+	box.PackStart(buttons, false, false, 2)
+
+	replyBtn, err := gtk.ButtonNewWithLabel("Reply")
+	if err != nil {
+		log.Fatal("Unable to create button:", err)
+	}
+	replyBtn.Connect("clicked", func() {
+		text, ok := textInputDialog(c.window, "Reply", "Reply:")
+		if ok {
+			thread := c.threads[cm.ID]
+			thread.Replies = append(thread.Replies, Reply{Author: c.author(), Time: time.Now(), Text: text})
+			glib.IdleAdd(func() bool {
+				c.Refresh()
+				return false
+			})
+		}
+	})
+	buttons.PackStart(replyBtn, false, false, 0)
+
+	resolveLabel := "Resolve"
+	if cm.Resolved {
+		resolveLabel = "Reopen"
+	}
+	resolveBtn, err := gtk.ButtonNewWithLabel(resolveLabel)
+	if err != nil {
+		log.Fatal("Unable to create button:", err)
+	}
+	resolveBtn.Connect("clicked", func() {
+		c.threads[cm.ID].Resolved = !cm.Resolved
+		glib.IdleAdd(func() bool {
+			c.Refresh()
+			return false
+		})
+	})
+	buttons.PackStart(resolveBtn, false, false, 0)
+
+	deleteBtn, err := gtk.ButtonNewWithLabel("Delete")
+	if err != nil {
+		log.Fatal("Unable to create button:", err)
+	}
+	deleteBtn.Connect("clicked", func() {
+		glib.IdleAdd(func() bool {
+			c.Delete(cm.ID)
+			return false
+		})
+	})
+	buttons.PackStart(deleteBtn, false, false, 0)
+
+	return frame
+}
+
+// Ask for a multi-line text; ok is false when cancelled or left empty
+func textInputDialog(parent *gtk.Window, title, prompt string) (string, bool) {
+	dialog, err := gtk.DialogNew()
+	if err != nil {
+		log.Fatal("Unable to create dialog:", err)
+	}
+	dialog.SetTitle(title)
+	dialog.SetTransientFor(parent)
+	dialog.SetModal(true)
+	dialog.SetDefaultSize(300, 150)
+	dialog.AddButton("OK", gtk.RESPONSE_ACCEPT)
+	dialog.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+
+	vbox, err := dialog.GetContentArea()
+	if err != nil {
+		log.Fatal("Unable to get content area:", err)
+	}
+	label, err := gtk.LabelNew(prompt)
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	textView, err := gtk.TextViewNew()
+	if err != nil {
+		log.Fatal("Unable to create text view:", err)
+	}
+	textView.SetWrapMode(gtk.WRAP_WORD)
+	vbox.PackStart(label, false, false, 5)
+	vbox.PackStart(textView, true, true, 5)
+	vbox.ShowAll()
+
+	defer dialog.Destroy()
+	if dialog.Run() != gtk.RESPONSE_ACCEPT {
+		return "", false
+	}
+	buffer, err := textView.GetBuffer()
+	if err != nil {
+		log.Fatal("Unable to get buffer:", err)
+	}
+	start, end := buffer.GetBounds()
+	text, _ := buffer.GetText(start, end, false)
+	text = strings.TrimSpace(text)
+	return text, text != ""
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The merge dialog's data source entry for a CSV or JSON file
+const fileSourceID = "file:"
+
+// Delimiters a CSV file may use, the most likely first
+var csvDelimiters = []rune{',', ';', '\t', '|'}
+
+// Records looked at to settle on a delimiter
+const csvSniffRecords = 20
+
+// readCSV reads a CSV file whose first row names the fields. The
+// encoding and delimiter are detected. Blank and repeated names are made
+// unique, and short rows are padded with empty fields.
+func readCSV(filename string) ([]string, [][]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	text, _, err := decodeText(data, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	r := newCSVReader(text, detectDelimiter(text))
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("%s is empty", filepath.Base(filename))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	columns := csvColumns(header)
+	var records [][]string
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(record) > len(columns) {
+			line, _ := r.FieldPos(0)
+			return nil, nil, fmt.Errorf("line %d has %d fields but the header names %d", line, len(record), len(columns))
+		}
+		// A blank line is not a record
+		if len(record) == 1 && record[0] == "" && len(columns) > 1 {
+			continue
+		}
+		for len(record) < len(columns) {
+			record = append(record, "")
+		}
+		records = append(records, record)
+	}
+	return columns, records, nil
+}
+
+func newCSVReader(text string, delimiter rune) *csv.Reader {
+	r := csv.NewReader(strings.NewReader(text))
+	r.Comma = delimiter
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	return r
+}
+
+// detectDelimiter picks the delimiter that splits the first records into
+// the most fields, the same number on every row; failing that, the one
+// that splits the header most
+func detectDelimiter(text string) rune {
+	best, bestFields := csvDelimiters[0], 1
+	fallback, fallbackFields := csvDelimiters[0], 1
+	for _, delim := range csvDelimiters {
+		r := newCSVReader(text, delim)
+		header, err := r.Read()
+		if err != nil {
+			continue
+		}
+		if len(header) > fallbackFields {
+			fallback, fallbackFields = delim, len(header)
+		}
+		consistent := true
+		for i := 0; i < csvSniffRecords; i++ {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil || len(record) != len(header) {
+				consistent = false
+				break
+			}
+		}
+		if consistent && len(header) > bestFields {
+			best, bestFields = delim, len(header)
+		}
+	}
+	if bestFields > 1 {
+		return best
+	}
+	return fallback
+}
+
+// Field names from a header row, trimmed, with blanks named Column1 and
+// so on and repeats given _2, _3
+func csvColumns(header []string) []string {
+	columns := make([]string, len(header))
+	used := map[string]bool{}
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			name = "Column" + strconv.Itoa(i+1)
+		}
+		unique := name
+		for n := 2; used[strings.ToLower(unique)]; n++ {
+			unique = fmt.Sprintf("%s_%d", name, n)
+		}
+		// SQLite column names ignore case
+		used[strings.ToLower(unique)] = true
+		columns[i] = unique
+	}
+	return columns
+}
+
+// openDataFile loads a CSV, JSON or JSON Lines file, by extension, into
+// a new in-memory database as a table named after the file, so filters
+// and sorting work as on any other source. Close the database when done
+// with it.
+func openDataFile(filename string) (*sql.DB, string, error) {
+	read := readCSV
+	if isJSONFile(filename) {
+		read = readJSON
+	}
+	columns, records, err := read(filename)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading %s: %w", filepath.Base(filename), err)
+	}
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		return nil, "", err
+	}
+	// Every connection to :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+	table := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	if err := loadMemoryTable(db, table, columns, records); err != nil {
+		db.Close()
+		return nil, "", fmt.Errorf("loading %s: %w", filepath.Base(filename), err)
+	}
+	return db, table, nil
+}
+
+func loadMemoryTable(db *sql.DB, table string, columns []string, records [][]string) error {
+	defs := make([]string, len(columns))
+	marks := make([]string, len(columns))
+	for i, col := range columns {
+		defs[i] = quoteIdent(col) + " TEXT"
+		marks[i] = "?"
+	}
+	if _, err := db.Exec("CREATE TABLE " + quoteIdent(table) + " (" + strings.Join(defs, ", ") + ")"); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("INSERT INTO " + quoteIdent(table) + " VALUES (" + strings.Join(marks, ", ") + ")")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	args := make([]interface{}, len(columns))
+	for _, record := range records {
+		for i, v := range record {
+			args[i] = v
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
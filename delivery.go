@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every message an email merge sends is logged here, in the merge
+// database, so an interrupted merge can pick up where it stopped
+const deliveriesTable = "goatpad_deliveries"
+
+// The wait before the first retry of a message; it doubles for each
+// retry after, up to a minute
+var retryBackoff = time.Second
+
+// A server without STARTTLS will not grow it by trying again
+var errNoSTARTTLS = errors.New("server does not offer STARTTLS")
+
+// Connection security
+const (
+	securitySTARTTLS = "starttls"
+	securityTLS      = "tls"
+	securityNone     = "none"
+)
+
+// Delivery log statuses
+const (
+	deliverySent   = "sent"
+	deliveryFailed = "failed"
+	deliveryTest   = "test" // sent to the test address instead
+)
+
+// SMTPOptions send an email merge straight to a mail server
+type SMTPOptions struct {
+	Server   string // host:port; the port defaults to suit Security
+	Security string // starttls (the default), tls or none
+	Username string // no authentication if empty
+	Password string
+	Auth     string  // plain (the default) or login
+	Rate     float64 // messages per minute; 0 for no limit
+	Retries  int     // further tries after a temporary failure
+	// Dry run: every message goes to this address instead, with the
+	// real recipients in X-Original-To
+	TestAddress string
+}
+
+// The envelope of a message: where the server is told it is from and to
+type Envelope struct {
+	From string
+	To   []string
+}
+
+// Sender delivers the messages of an email merge over one SMTP
+// connection, a message at a time, keeping to the rate and retrying
+// temporary failures. Safe for concurrent use.
+type Sender struct {
+	opts SMTPOptions
+	db   *sql.DB
+	job  string // delivery log key for this merge
+	host string
+	addr string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	client *smtp.Client
+	next   time.Time // the rate allows no message before this
+}
+
+func newSender(db *sql.DB, opts SMTPOptions, job string) (*Sender, error) {
+	if opts.Security == "" {
+		opts.Security = securitySTARTTLS
+	}
+	port := map[string]string{securitySTARTTLS: "587", securityTLS: "465", securityNone: "25"}[opts.Security]
+	if port == "" {
+		return nil, fmt.Errorf("unknown SMTP security %q: use starttls, tls or none", opts.Security)
+	}
+	if opts.Auth == "" {
+		opts.Auth = "plain"
+	}
+	if opts.Auth != "plain" && opts.Auth != "login" {
+		return nil, fmt.Errorf("unknown SMTP authentication %q: use plain or login", opts.Auth)
+	}
+	host, p, err := net.SplitHostPort(opts.Server)
+	if err != nil {
+		host, p = opts.Server, port
+	}
+	if host == "" {
+		return nil, fmt.Errorf("no SMTP server given")
+	}
+	if opts.TestAddress != "" {
+		addr, err := mailAddress(opts.TestAddress)
+		if err != nil {
+			return nil, fmt.Errorf("test address: %w", err)
+		}
+		opts.TestAddress = addr
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS " + deliveriesTable + " (job TEXT, record TEXT, recipients TEXT, status TEXT, attempts INTEGER, error TEXT, time TEXT)")
+	if err != nil {
+		return nil, err
+	}
+	return &Sender{opts: opts, db: db, job: job, host: host, addr: net.JoinHostPort(host, p)}, nil
+}
+
+// deliveryJob names a merge in the delivery log. Runs with the same
+// template, source, filter and headers are the same merge, so a rerun
+// resumes it.
+func deliveryJob(job MergeJob) string {
+	key := []interface{}{job.Template, job.Table, job.Filter, job.Email}
+	if job.DataFile != "" {
+		key = append(key, job.DataFile)
+	}
+	if job.Query != "" {
+		key = append(key, job.Query)
+	}
+	data, _ := json.Marshal(key)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Sent reports whether an earlier run of this merge already delivered
+// record to these recipients, and when. A dry run sends everything.
+func (s *Sender) Sent(record string, to []string) (string, bool) {
+	if s.opts.TestAddress != "" {
+		return "", false
+	}
+	// Reads and inserts of the log both hold the lock, so workers never
+	// find the database busy
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var when string
+	err := s.db.QueryRow("SELECT time FROM "+deliveriesTable+" WHERE job = ? AND record = ? AND recipients = ? AND status = ? ORDER BY time DESC LIMIT 1",
+		s.job, record, strings.Join(to, ", "), deliverySent).Scan(&when)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Delivery log error:", err)
+	}
+	return when, err == nil
+}
+
+// Deliver sends msg for record and logs how it went
+func (s *Sender) Deliver(ctx context.Context, record string, env Envelope, msg []byte) error {
+	// The real recipients are logged, so a rerun knows who has had it
+	recipients := strings.Join(env.To, ", ")
+	status := deliverySent
+	if s.opts.TestAddress != "" {
+		status = deliveryTest
+		msg = append([]byte("X-Original-To: "+recipients+"\r\n"), msg...)
+		env = Envelope{From: env.From, To: []string{s.opts.TestAddress}}
+	}
+	// Logged under the lock too, see Sent
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts, err := s.send(ctx, env, msg)
+	errText := ""
+	if err != nil {
+		status, errText = deliveryFailed, err.Error()
+	}
+	if _, logErr := s.db.Exec("INSERT INTO "+deliveriesTable+" (job, record, recipients, status, attempts, error, time) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		s.job, record, recipients, status, attempts, errText, time.Now().Format(time.RFC3339)); logErr != nil {
+		log.Println("Delivery log error:", logErr)
+	}
+	return err
+}
+
+// Send with retries, waiting for the rate between messages and backing
+// off between tries. Returns the number of tries made. s.mu must be
+// held.
+func (s *Sender) send(ctx context.Context, env Envelope, msg []byte) (int, error) {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		if err := sleepUntil(ctx, s.next); err != nil {
+			return attempt - 1, err
+		}
+		err := s.sendOnce(ctx, env, msg)
+		if s.opts.Rate > 0 {
+			s.next = time.Now().Add(time.Duration(float64(time.Minute) / s.opts.Rate))
+		}
+		if err == nil {
+			return attempt, nil
+		}
+		// Start afresh on a new connection after any failure
+		s.reset()
+		if attempt > s.opts.Retries || !temporary(err) {
+			return attempt, err
+		}
+		log.Printf("Send error, retrying in %s: %v", backoff, err)
+		if err := sleepUntil(ctx, time.Now().Add(backoff)); err != nil {
+			return attempt, err
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func (s *Sender) sendOnce(ctx context.Context, env Envelope, msg []byte) error {
+	if s.client == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	// No single message should take this long
+	s.conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	c := s.client
+	if err := c.Mail(env.From); err != nil {
+		return err
+	}
+	for _, to := range env.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (s *Sender) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	config := &tls.Config{ServerName: s.host}
+	var conn net.Conn
+	var err error
+	if s.opts.Security == securityTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: config}).DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if s.opts.Security == securitySTARTTLS {
+		// Never fall back to sending in the clear
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return fmt.Errorf("%s: %w", s.addr, errNoSTARTTLS)
+		}
+		if err := c.StartTLS(config); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	if s.opts.Username != "" {
+		var auth smtp.Auth = smtp.PlainAuth("", s.opts.Username, s.opts.Password, s.host)
+		if s.opts.Auth == "login" {
+			auth = &loginAuth{s.opts.Username, s.opts.Password, s.host}
+		}
+		if err := c.Auth(auth); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	s.conn, s.client = conn, c
+	return nil
+}
+
+// Close says goodbye to the server
+func (s *Sender) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		s.client.Quit()
+		s.client = nil
+	}
+}
+
+func (s *Sender) reset() {
+	if s.client != nil {
+		s.client.Close()
+		s.client = nil
+	}
+}
+
+// SMTP 4xx replies and network trouble may clear up; 5xx replies will not
+func temporary(err error) bool {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return reply.Code >= 400 && reply.Code < 500
+	}
+	var certErr *tls.CertificateVerificationError
+	return !errors.As(err, &certErr) && !errors.Is(err, errNoSTARTTLS)
+}
+
+// Wait until t, or until ctx is done
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LOGIN authentication, for servers without PLAIN. Like PLAIN it is
+// refused over an unencrypted connection except to localhost.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	local := server.Name == "localhost" || server.Name == "127.0.0.1" || server.Name == "::1"
+	if !server.TLS && !local {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN prompt %q", fromServer)
+}
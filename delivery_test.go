@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A message as the fake server received it
+type fakeMessage struct {
+	From     string
+	To       []string
+	Data     string
+	Received time.Time
+}
+
+// fakeSMTP is a local SMTP stand-in. Each message gets the next of
+// replies after its data, or 250 once they run out; messages to refuse
+// always get 550.
+type fakeSMTP struct {
+	addr     string
+	mu       sync.Mutex
+	replies  []int
+	refuse   string
+	messages []fakeMessage
+	tries    int // messages offered, accepted or not
+}
+
+func newFakeSMTP(t *testing.T, replies ...int) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	f := &fakeSMTP{addr: ln.Addr().String(), replies: replies}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+	reply("220 localhost ESMTP")
+	var msg fakeMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.Fields(line + " ")[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case "MAIL":
+			msg = fakeMessage{From: addressOf(line)}
+			reply("250 OK")
+		case "RCPT":
+			msg.To = append(msg.To, addressOf(line))
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			msg.Data, msg.Received = data.String(), time.Now()
+			f.mu.Lock()
+			f.tries++
+			code := 250
+			if len(f.replies) > 0 {
+				code, f.replies = f.replies[0], f.replies[1:]
+			}
+			if len(msg.To) > 0 && msg.To[0] == f.refuse {
+				code = 550
+			}
+			if code == 250 {
+				f.messages = append(f.messages, msg)
+			}
+			f.mu.Unlock()
+			reply(strconv.Itoa(code) + " Reply " + strconv.Itoa(code))
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+// The address in MAIL FROM:<a> or RCPT TO:<a>
+func addressOf(line string) string {
+	start, end := strings.Index(line, "<"), strings.Index(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func (f *fakeSMTP) received() ([]fakeMessage, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeMessage{}, f.messages...), f.tries
+}
+
+func testDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func testSender(t *testing.T, db *sql.DB, opts SMTPOptions) *Sender {
+	opts.Security = securityNone
+	s, err := newSender(db, opts, "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// A delivery log row
+type deliveryRow struct {
+	record, recipients, status, err string
+	attempts                        int
+}
+
+func deliveries(t *testing.T, db *sql.DB) []deliveryRow {
+	rows, err := db.Query("SELECT record, recipients, status, attempts, error FROM " + deliveriesTable + " ORDER BY rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var list []deliveryRow
+	for rows.Next() {
+		var r deliveryRow
+		if err := rows.Scan(&r.record, &r.recipients, &r.status, &r.attempts, &r.err); err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, r)
+	}
+	return list
+}
+
+func shortBackoff(t *testing.T, d time.Duration) {
+	saved := retryBackoff
+	retryBackoff = d
+	t.Cleanup(func() { retryBackoff = saved })
+}
+
+var testEnvelope = Envelope{From: "from@example.com", To: []string{"to@example.com"}}
+
+const testMessage = "Subject: Hello\r\n\r\nHi there\r\n"
+
+func TestSenderRetriesTemporaryFailure(t *testing.T) {
+	shortBackoff(t, 100*time.Millisecond)
+	server := newFakeSMTP(t, 451, 250)
+	db := testDB(t)
+	s := testSender(t, db, SMTPOptions{Server: server.addr, Retries: 2})
+
+	started := time.Now()
+	if err := s.Deliver(context.Background(), "1", testEnvelope, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed < retryBackoff {
+		t.Errorf("retried after %s, want a backoff of at least %s", elapsed, retryBackoff)
+	}
+	messages, tries := server.received()
+	if tries != 2 || len(messages) != 1 {
+		t.Fatalf("server saw %d tries and accepted %d messages, want 2 and 1", tries, len(messages))
+	}
+	if got := messages[0].Data; !strings.Contains(got, "Hi there") {
+		t.Errorf("message data = %q", got)
+	}
+	rows := deliveries(t, db)
+	if len(rows) != 1 || rows[0].status != deliverySent || rows[0].attempts != 2 || rows[0].recipients != "to@example.com" {
+		t.Errorf("delivery log = %+v, want one sent row with 2 attempts", rows)
+	}
+}
+
+func TestSenderPermanentFailureNotRetried(t *testing.T) {
+	shortBackoff(t, 10*time.Millisecond)
+	server := newFakeSMTP(t, 550)
+	db := testDB(t)
+	s := testSender(t, db, SMTPOptions{Server: server.addr, Retries: 3})
+
+	err := s.Deliver(context.Background(), "1", testEnvelope, []byte(testMessage))
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Fatalf("Deliver error = %v, want the 550 reply", err)
+	}
+	if _, tries := server.received(); tries != 1 {
+		t.Errorf("server saw %d tries, want 1", tries)
+	}
+	rows := deliveries(t, db)
+	if len(rows) != 1 || rows[0].status != deliveryFailed || rows[0].attempts != 1 || !strings.Contains(rows[0].err, "550") {
+		t.Errorf("delivery log = %+v, want one failed row with 1 attempt", rows)
+	}
+}
+
+func TestSenderGivesUpAfterRetries(t *testing.T) {
+	shortBackoff(t, 10*time.Millisecond)
+	server := newFakeSMTP(t, 421, 421, 421)
+	db := testDB(t)
+	s := testSender(t, db, SMTPOptions{Server: server.addr, Retries: 2})
+
+	if err := s.Deliver(context.Background(), "1", testEnvelope, []byte(testMessage)); err == nil {
+		t.Fatal("Deliver succeeded, want the 421 reply")
+	}
+	if _, tries := server.received(); tries != 3 {
+		t.Errorf("server saw %d tries, want 3", tries)
+	}
+	if rows := deliveries(t, db); len(rows) != 1 || rows[0].attempts != 3 {
+		t.Errorf("delivery log = %+v, want one row with 3 attempts", rows)
+	}
+}
+
+func TestSenderRate(t *testing.T) {
+	server := newFakeSMTP(t)
+	db := testDB(t)
+	// 600 a minute is one every 100ms
+	s := testSender(t, db, SMTPOptions{Server: server.addr, Rate: 600})
+	for i := 1; i <= 3; i++ {
+		if err := s.Deliver(context.Background(), strconv.Itoa(i), testEnvelope, []byte(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, _ := server.received()
+	if len(messages) != 3 {
+		t.Fatalf("server accepted %d messages, want 3", len(messages))
+	}
+	for i := 1; i < len(messages); i++ {
+		if gap := messages[i].Received.Sub(messages[i-1].Received); gap < 100*time.Millisecond {
+			t.Errorf("messages %d and %d were %s apart, want at least 100ms", i, i+1, gap)
+		}
+	}
+}
+
+func TestSenderTestAddress(t *testing.T) {
+	server := newFakeSMTP(t)
+	db := testDB(t)
+	s := testSender(t, db, SMTPOptions{Server: server.addr, TestAddress: "Tester <test@example.com>"})
+
+	env := Envelope{From: "from@example.com", To: []string{"ann@example.com", "bob@example.com"}}
+	if err := s.Deliver(context.Background(), "1", env, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := server.received()
+	if len(messages) != 1 {
+		t.Fatalf("server accepted %d messages, want 1", len(messages))
+	}
+	if got := messages[0].To; len(got) != 1 || got[0] != "test@example.com" {
+		t.Errorf("recipients = %v, want only the test address", got)
+	}
+	if got := messages[0].Data; !strings.HasPrefix(got, "X-Original-To: ann@example.com, bob@example.com\r\n") {
+		t.Errorf("message does not start with X-Original-To: %q", got)
+	}
+	rows := deliveries(t, db)
+	if len(rows) != 1 || rows[0].status != deliveryTest || rows[0].recipients != "ann@example.com, bob@example.com" {
+		t.Errorf("delivery log = %+v, want one test row for the real recipients", rows)
+	}
+	// A dry run resends everything
+	if _, sent := s.Sent("1", env.To); sent {
+		t.Error("Sent reported a test delivery as sent")
+	}
+}
+
+func TestSenderSent(t *testing.T) {
+	server := newFakeSMTP(t)
+	db := testDB(t)
+	s := testSender(t, db, SMTPOptions{Server: server.addr})
+	if err := s.Deliver(context.Background(), "1", testEnvelope, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rerun of the same merge
+	again := testSender(t, db, SMTPOptions{Server: server.addr})
+	if _, sent := again.Sent("1", testEnvelope.To); !sent {
+		t.Error("record 1 not reported as sent")
+	}
+	if _, sent := again.Sent("2", testEnvelope.To); sent {
+		t.Error("record 2 reported as sent")
+	}
+	if _, sent := again.Sent("1", []string{"other@example.com"}); sent {
+		t.Error("record 1 reported as sent to a new recipient")
+	}
+	other, err := newSender(db, SMTPOptions{Server: server.addr, Security: securityNone}, "another job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, sent := other.Sent("1", testEnvelope.To); sent {
+		t.Error("record 1 reported as sent by another merge")
+	}
+}
+
+func TestMailMergeResumesSending(t *testing.T) {
+	server := newFakeSMTP(t)
+	server.refuse = "bob@example.com"
+	db := testDB(t)
+	if _, err := db.Exec("CREATE TABLE contacts (id INTEGER, Name TEXT, Email TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO contacts VALUES (1, 'Ann', 'ann@example.com'), (2, 'Bob', 'bob@example.com')"); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	template := filepath.Join(dir, "letter.txt")
+	if err := os.WriteFile(template, []byte("Dear {{Name}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	job := MergeJob{
+		Table:    "contacts",
+		Template: template,
+		Output:   dir,
+		Email:    &EmailOptions{From: "from@example.com", To: "{{.Email}}", Subject: "Hello {{.Name}}"},
+		SMTP:     &SMTPOptions{Server: server.addr, Security: securityNone},
+	}
+	statuses := func(report *MergeReport) []string {
+		var list []string
+		for _, result := range report.Results {
+			list = append(list, result.Status)
+		}
+		return list
+	}
+
+	// Bob's message is refused the first time
+	report, err := mailMerge(context.Background(), db, job, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(statuses(report), ","); got != "ok,failed" {
+		t.Fatalf("first run = %s, want ok,failed", got)
+	}
+	server.mu.Lock()
+	server.refuse = ""
+	server.mu.Unlock()
+	// The rerun skips Ann and sends Bob's
+	report, err = mailMerge(context.Background(), db, job, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(statuses(report), ","); got != "skipped,ok" {
+		t.Fatalf("second run = %s, want skipped,ok", got)
+	}
+	messages, _ := server.received()
+	if len(messages) != 2 || messages[0].To[0] != "ann@example.com" || messages[1].To[0] != "bob@example.com" {
+		t.Errorf("server accepted %+v, want Ann's then Bob's", messages)
+	}
+	if rows := deliveries(t, db); len(rows) != 3 {
+		t.Errorf("delivery log has %d rows, want 3", len(rows))
+	}
+}
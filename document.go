@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Native document format. A .goat file is a JSON snapshot of the editor:
+// the buffer text plus every tagged range, so formatting and review data
+// survive a save/open round trip. Offsets are in characters (runes), the
+// same unit GtkTextBuffer uses.
+const nativeExt = ".goat"
+
+type TagSpan struct {
+	Tag   string `json:"tag"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Value string `json:"value,omitempty"` // e.g. point size for "size"
+}
+
+// Change kinds
+const (
+	ChangeInsert = "insert"
+	ChangeDelete = "delete"
+)
+
+// Change is a tracked insertion or deletion. Deleted text stays in the
+// buffer until the change is accepted.
+type Change struct {
+	ID     int       `json:"id"`
+	Kind   string    `json:"kind"`
+	Author string    `json:"author"`
+	Time   time.Time `json:"time"`
+	Start  int       `json:"start"`
+	End    int       `json:"end"`
+}
+
+// Reply is an answer in a comment thread
+type Reply struct {
+	Author string    `json:"author"`
+	Time   time.Time `json:"time"`
+	Text   string    `json:"text"`
+}
+
+// Comment is a note anchored to a range of text. It does not change the
+// text itself.
+type Comment struct {
+	ID       int       `json:"id"`
+	Author   string    `json:"author"`
+	Time     time.Time `json:"time"`
+	Text     string    `json:"text"`
+	Start    int       `json:"start"`
+	End      int       `json:"end"`
+	Resolved bool      `json:"resolved,omitempty"`
+	Replies  []Reply   `json:"replies,omitempty"`
+}
+
+// Properties is the document metadata written into every format that
+// has a place for it. Keywords are comma separated.
+type Properties struct {
+	Title    string `json:"title,omitempty"`
+	Author   string `json:"author,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+	Keywords string `json:"keywords,omitempty"`
+}
+
+// KeywordList splits Keywords at commas
+func (p Properties) KeywordList() []string {
+	var list []string
+	for _, k := range strings.Split(p.Keywords, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			list = append(list, k)
+		}
+	}
+	return list
+}
+
+type Document struct {
+	Props    Properties `json:"properties"`
+	Text     string     `json:"text"`
+	Tags     []TagSpan  `json:"tags,omitempty"`
+	Changes  []Change   `json:"changes,omitempty"`
+	Comments []Comment  `json:"comments,omitempty"`
+}
+
+// Formatting tags that are written to and restored from documents
+var formatTags = []string{"bold", "italic", "size", "left", "center"}
+
+func loadDocument(filename string) (*Document, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	doc := &Document{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func saveDocument(filename string, doc *Document) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+// FinalText returns the text as it reads with every pending deletion
+// applied, which is what plain text and RTF exports contain.
+func (d *Document) FinalText() string {
+	runes := []rune(d.Text)
+	deleted := make([]bool, len(runes))
+	for _, c := range d.Changes {
+		if c.Kind != ChangeDelete {
+			continue
+		}
+		for i := clamp(c.Start, 0, len(runes)); i < clamp(c.End, 0, len(runes)); i++ {
+			deleted[i] = true
+		}
+	}
+	out := make([]rune, 0, len(runes))
+	for i, r := range runes {
+		if !deleted[i] {
+			out = append(out, r)
+		}
+	}
+	return string(out)
+}
+
+// Slice returns the text and formatting of start..end as its own
+// document, as copied to the clipboard. Pending deletions are left out
+// and review state is dropped.
+func (d *Document) Slice(start, end int) *Document {
+	runes := []rune(d.Text)
+	start, end = clamp(start, 0, len(runes)), clamp(end, start, len(runes))
+	deleted := make([]bool, len(runes))
+	for _, c := range d.Changes {
+		if c.Kind != ChangeDelete {
+			continue
+		}
+		for i := clamp(c.Start, 0, len(runes)); i < clamp(c.End, 0, len(runes)); i++ {
+			deleted[i] = true
+		}
+	}
+	// newOff[i] is where old offset i lands in the slice
+	newOff := make([]int, len(runes)+1)
+	out := make([]rune, 0, end-start)
+	for i := start; i < end; i++ {
+		newOff[i] = len(out)
+		if !deleted[i] {
+			out = append(out, runes[i])
+		}
+	}
+	newOff[end] = len(out)
+
+	sub := &Document{Text: string(out)}
+	for _, t := range d.Tags {
+		from, to := clamp(t.Start, start, end), clamp(t.End, start, end)
+		if newOff[from] < newOff[to] {
+			sub.Tags = append(sub.Tags, TagSpan{Tag: t.Tag, Start: newOff[from], End: newOff[to], Value: t.Value})
+		}
+	}
+	return sub
+}
+
+// A paragraph holding only a form feed is a page break
+const pageBreak = "\f"
+
+// combineDocuments joins docs into one, each starting on a new page, as
+// merged output is combined. Review state is dropped; properties come
+// from the first.
+func combineDocuments(docs []*Document) *Document {
+	combined := &Document{}
+	var text strings.Builder
+	offset := 0
+	for i, doc := range docs {
+		if i == 0 {
+			combined.Props = doc.Props
+		} else {
+			text.WriteString("\n" + pageBreak + "\n")
+			offset += 3
+		}
+		text.WriteString(doc.Text)
+		for _, t := range doc.Tags {
+			t.Start += offset
+			t.End += offset
+			combined.Tags = append(combined.Tags, t)
+		}
+		offset += utf8.RuneCountInString(doc.Text)
+	}
+	combined.Text = text.String()
+	return combined
+}
+
+// Run is a stretch of text with a constant set of tags and at most one
+// tracked change. Exporters walk a document run by run.
+type Run struct {
+	Start  int // offset of the first character
+	End    int
+	Text   string
+	Tags   map[string]string // tag name -> value
+	Change *Change
+}
+
+// Paragraph is one line of the document split into runs.
+type Paragraph struct {
+	Runs []Run
+}
+
+// PageBreak reports whether the paragraph is a page break between
+// combined documents
+func (p Paragraph) PageBreak() bool {
+	return len(p.Runs) == 1 && p.Runs[0].Text == pageBreak
+}
+
+// Align returns the paragraph alignment ("left" or "center").
+func (p Paragraph) Align() string {
+	for _, r := range p.Runs {
+		if _, ok := r.Tags["center"]; ok {
+			return "center"
+		}
+	}
+	return "left"
+}
+
+// Paragraphs splits the document into paragraphs at newlines and each
+// paragraph into runs at every tag, change or comment boundary.
+func (d *Document) Paragraphs() []Paragraph {
+	runes := []rune(d.Text)
+	cuts := map[int]bool{0: true, len(runes): true}
+	for _, t := range d.Tags {
+		cuts[clamp(t.Start, 0, len(runes))] = true
+		cuts[clamp(t.End, 0, len(runes))] = true
+	}
+	for _, c := range d.Changes {
+		cuts[clamp(c.Start, 0, len(runes))] = true
+		cuts[clamp(c.End, 0, len(runes))] = true
+	}
+	for _, c := range d.Comments {
+		cuts[clamp(c.Start, 0, len(runes))] = true
+		cuts[clamp(c.End, 0, len(runes))] = true
+	}
+	for i, r := range runes {
+		if r == '\n' {
+			cuts[i] = true
+			cuts[i+1] = true
+		}
+	}
+	bounds := make([]int, 0, len(cuts))
+	for off := range cuts {
+		bounds = append(bounds, off)
+	}
+	sort.Ints(bounds)
+
+	paras := []Paragraph{{}}
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		if start == end {
+			continue
+		}
+		if runes[start] == '\n' {
+			paras = append(paras, Paragraph{})
+			continue
+		}
+		run := Run{Start: start, End: end, Text: string(runes[start:end]), Tags: map[string]string{}}
+		for _, t := range d.Tags {
+			if t.Start <= start && end <= t.End {
+				run.Tags[t.Tag] = t.Value
+			}
+		}
+		for j := range d.Changes {
+			c := &d.Changes[j]
+			if c.Start <= start && end <= c.End {
+				run.Change = c
+				break
+			}
+		}
+		p := &paras[len(paras)-1]
+		p.Runs = append(p.Runs, run)
+	}
+	return paras
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	docxNS      = `xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"`
+	docxRNS     = `xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"`
+	docxW14NS   = `xmlns:w14="http://schemas.microsoft.com/office/word/2010/wordml"`
+	docxW15NS   = `xmlns:w15="http://schemas.microsoft.com/office/word/2012/wordml"`
+	docxRelBase = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/"
+	docxTypBase = "application/vnd.openxmlformats-officedocument.wordprocessingml."
+	docxWordNS  = "http://schemas.openxmlformats.org/wordprocessingml/2006/main"
+)
+
+// A file inside a zip based document package. For DOCX, parts with a
+// relType are referenced from word/document.xml.
+type zipPart struct {
+	name        string
+	contentType string
+	relType     string
+	body        string
+}
+
+// Write document as a minimal Office Open XML package
+func saveDOCX(filename string, doc *Document) error {
+	return writeZip(filename, docxPackage(doc))
+}
+
+func docxPackage(doc *Document) []zipPart {
+	links := docxLinks(doc)
+	parts := []zipPart{
+		{"word/document.xml", docxTypBase + "document.main+xml", "", docxDocument(doc, links)},
+	}
+	if len(doc.Comments) > 0 {
+		comments, extended := docxComments(doc)
+		parts = append(parts,
+			zipPart{"word/comments.xml", docxTypBase + "comments+xml", docxRelBase + "comments", comments},
+			zipPart{"word/commentsExtended.xml", docxTypBase + "commentsExtended+xml",
+				"http://schemas.microsoft.com/office/2011/relationships/commentsExtended", extended},
+		)
+	}
+
+	var types, rels strings.Builder
+	types.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	types.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`)
+	types.WriteString(`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`)
+	types.WriteString(`<Default Extension="xml" ContentType="application/xml"/>`)
+	rels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	rels.WriteString(`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i, part := range parts {
+		fmt.Fprintf(&types, `<Override PartName="/%s" ContentType="%s"/>`, part.name, part.contentType)
+		if part.relType != "" {
+			fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="%s" Target="%s"/>`,
+				i, part.relType, strings.TrimPrefix(part.name, "word/"))
+		}
+	}
+	written := map[string]bool{}
+	for _, t := range doc.Tags {
+		if t.Tag == "link" && !written[t.Value] {
+			written[t.Value] = true
+			fmt.Fprintf(&rels, `<Relationship Id="%s" Type="%shyperlink" Target="%s" TargetMode="External"/>`,
+				links[t.Value], docxRelBase, xmlEscape(t.Value))
+		}
+	}
+	rels.WriteString(`</Relationships>`)
+
+	// Metadata lives in docProps/core.xml, referenced from the package
+	var rootRels strings.Builder
+	rootRels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	rootRels.WriteString(`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	rootRels.WriteString(`<Relationship Id="rId1" Type="` + docxRelBase + `officeDocument" Target="word/document.xml"/>`)
+	rootRels.WriteString(`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/package/2006/relationships/metadata/core-properties" Target="docProps/core.xml"/>`)
+	rootRels.WriteString(`</Relationships>`)
+	types.WriteString(`<Override PartName="/docProps/core.xml" ContentType="application/vnd.openxmlformats-package.core-properties+xml"/>`)
+	types.WriteString(`</Types>`)
+
+	parts = append(parts,
+		zipPart{name: "[Content_Types].xml", body: types.String()},
+		zipPart{name: "_rels/.rels", body: rootRels.String()},
+		zipPart{name: "word/_rels/document.xml.rels", body: rels.String()},
+		zipPart{name: "docProps/core.xml", body: docxCoreProps(doc.Props)},
+	)
+	return parts
+}
+
+// Write parts in order; a "mimetype" entry is stored uncompressed as ODF
+// requires.
+func writeZip(filename string, parts []zipPart) error {
+	data, err := zipBytes(parts)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+func zipBytes(parts []zipPart) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, part := range parts {
+		header := &zip.FileHeader{Name: part.name, Method: zip.Deflate}
+		if part.name == "mimetype" {
+			header.Method = zip.Store
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DOCX comment ids: each thread gets one id for the comment and one per
+// reply, numbered in document order.
+func docxCommentIDs(doc *Document) [][]int {
+	ids := make([][]int, len(doc.Comments))
+	next := 0
+	for i, c := range doc.Comments {
+		for j := 0; j <= len(c.Replies); j++ {
+			ids[i] = append(ids[i], next)
+			next++
+		}
+	}
+	return ids
+}
+
+// Relationship id for each distinct link target
+func docxLinks(doc *Document) map[string]string {
+	links := map[string]string{}
+	for _, t := range doc.Tags {
+		if t.Tag == "link" && links[t.Value] == "" {
+			links[t.Value] = fmt.Sprintf("rLink%d", len(links)+1)
+		}
+	}
+	return links
+}
+
+func docxDocument(doc *Document, links map[string]string) string {
+	commentIDs := docxCommentIDs(doc)
+	started := make([]bool, len(doc.Comments))
+	ended := make([]bool, len(doc.Comments))
+	endComments := func(b *strings.Builder, offset int) {
+		for i, c := range doc.Comments {
+			if !started[i] || ended[i] || c.End > offset {
+				continue
+			}
+			ended[i] = true
+			for _, id := range commentIDs[i] {
+				fmt.Fprintf(b, `<w:commentRangeEnd w:id="%d"/><w:r><w:commentReference w:id="%d"/></w:r>`, id, id)
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	b.WriteString(`<w:document ` + docxNS + ` ` + docxRNS + `><w:body>`)
+	paras := doc.Paragraphs()
+	for pi, p := range paras {
+		if p.PageBreak() {
+			// End the section; the next one starts on a new page
+			b.WriteString(`<w:p><w:pPr><w:sectPr><w:type w:val="nextPage"/></w:sectPr></w:pPr></w:p>`)
+			continue
+		}
+		b.WriteString("<w:p>")
+		if p.Align() == "center" {
+			b.WriteString(`<w:pPr><w:jc w:val="center"/></w:pPr>`)
+		}
+		for _, r := range p.Runs {
+			for i, c := range doc.Comments {
+				if !started[i] && c.Start <= r.Start {
+					started[i] = true
+					for _, id := range commentIDs[i] {
+						fmt.Fprintf(&b, `<w:commentRangeStart w:id="%d"/>`, id)
+					}
+				}
+			}
+			run := docxRun(r)
+			if c := r.Change; c != nil {
+				elem := "w:ins"
+				if c.Kind == ChangeDelete {
+					elem = "w:del"
+				}
+				run = fmt.Sprintf(`<%s w:id="%d" w:author="%s" w:date="%s">%s</%s>`,
+					elem, c.ID, xmlEscape(c.Author), c.Time.UTC().Format(time.RFC3339), run, elem)
+			}
+			if url, ok := r.Tags["link"]; ok {
+				run = fmt.Sprintf(`<w:hyperlink r:id="%s">%s</w:hyperlink>`, links[url], run)
+			}
+			b.WriteString(run)
+			endComments(&b, r.End)
+		}
+		if pi == len(paras)-1 {
+			endComments(&b, math.MaxInt)
+		}
+		b.WriteString("</w:p>")
+	}
+	b.WriteString("</w:body></w:document>")
+	return b.String()
+}
+
+func docxRun(r Run) string {
+	var props strings.Builder
+	if _, ok := r.Tags["bold"]; ok {
+		props.WriteString("<w:b/>")
+	}
+	if _, ok := r.Tags["italic"]; ok {
+		props.WriteString("<w:i/>")
+	}
+	if _, ok := r.Tags["link"]; ok {
+		props.WriteString(`<w:color w:val="0000EE"/><w:u w:val="single"/>`)
+	}
+	if size, ok := r.Tags["size"]; ok {
+		// w:sz is in half-points
+		if pt, err := strconv.ParseFloat(size, 64); err == nil {
+			fmt.Fprintf(&props, `<w:sz w:val="%d"/>`, int(pt*2))
+		}
+	}
+	textElem := "w:t"
+	if r.Change != nil && r.Change.Kind == ChangeDelete {
+		textElem = "w:delText"
+	}
+	run := "<w:r>"
+	if props.Len() > 0 {
+		run += "<w:rPr>" + props.String() + "</w:rPr>"
+	}
+	run += fmt.Sprintf(`<%s xml:space="preserve">%s</%s></w:r>`, textElem, xmlEscape(r.Text), textElem)
+	return run
+}
+
+func docxCoreProps(props Properties) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	b.WriteString(`<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" ` +
+		`xmlns:dc="http://purl.org/dc/elements/1.1/">`)
+	for _, field := range []struct{ elem, value string }{
+		{"dc:title", props.Title},
+		{"dc:subject", props.Subject},
+		{"dc:creator", props.Author},
+		{"cp:keywords", props.Keywords},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(&b, "<%s>%s</%s>", field.elem, xmlEscape(field.value), field.elem)
+		}
+	}
+	b.WriteString(`</cp:coreProperties>`)
+	return b.String()
+}
+
+// comments.xml holds the notes, commentsExtended.xml the reply threading
+// and resolved state, linked through paragraph ids.
+func docxComments(doc *Document) (comments, extended string) {
+	var c, x strings.Builder
+	c.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	c.WriteString(`<w:comments ` + docxNS + ` ` + docxW14NS + `>`)
+	x.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	x.WriteString(`<w15:commentsEx ` + docxW15NS + `>`)
+	write := func(id int, author string, t time.Time, text, parent string, done bool) string {
+		paraID := fmt.Sprintf("%08X", id+1)
+		fmt.Fprintf(&c, `<w:comment w:id="%d" w:author="%s" w:date="%s">`,
+			id, xmlEscape(author), t.UTC().Format(time.RFC3339))
+		// commentsExtended refers to the comment's last paragraph
+		lines := strings.Split(text, "\n")
+		for i, line := range lines {
+			pid := ""
+			if i == len(lines)-1 {
+				pid = ` w14:paraId="` + paraID + `"`
+			}
+			fmt.Fprintf(&c, `<w:p%s><w:r><w:t xml:space="preserve">%s</w:t></w:r></w:p>`, pid, xmlEscape(line))
+		}
+		c.WriteString(`</w:comment>`)
+		doneVal := "0"
+		if done {
+			doneVal = "1"
+		}
+		fmt.Fprintf(&x, `<w15:commentEx w15:paraId="%s"`, paraID)
+		if parent != "" {
+			fmt.Fprintf(&x, ` w15:paraIdParent="%s"`, parent)
+		}
+		fmt.Fprintf(&x, ` w15:done="%s"/>`, doneVal)
+		return paraID
+	}
+	ids := docxCommentIDs(doc)
+	for i, cm := range doc.Comments {
+		root := write(ids[i][0], cm.Author, cm.Time, cm.Text, "", cm.Resolved)
+		for j, r := range cm.Replies {
+			write(ids[i][j+1], r.Author, r.Time, r.Text, root, cm.Resolved)
+		}
+	}
+	c.WriteString(`</w:comments>`)
+	x.WriteString(`</w15:commentsEx>`)
+	return c.String(), x.String()
+}
+
+// parseDOCX reads a DOCX package into text with bold, italic, size,
+// center and link tags, as for a merge template. Tables and text boxes
+// are reduced to their text; tracked deletions and comments are dropped.
+func parseDOCX(data []byte) (*Document, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	read := func(name string) ([]byte, error) {
+		for _, f := range zr.File {
+			if f.Name == name {
+				rc, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer rc.Close()
+				return io.ReadAll(rc)
+			}
+		}
+		return nil, nil
+	}
+	body, err := read("word/document.xml")
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, fmt.Errorf("not a DOCX document: no word/document.xml")
+	}
+
+	// Link targets by relationship id
+	links := map[string]string{}
+	if data, err := read("word/_rels/document.xml.rels"); err == nil && data != nil {
+		var rels struct {
+			Rels []struct {
+				ID     string `xml:"Id,attr"`
+				Target string `xml:"Target,attr"`
+			} `xml:"Relationship"`
+		}
+		if err := xml.Unmarshal(data, &rels); err == nil {
+			for _, rel := range rels.Rels {
+				links[rel.ID] = rel.Target
+			}
+		}
+	}
+	doc := &Document{}
+	if data, err := read("docProps/core.xml"); err == nil && data != nil {
+		var core struct {
+			Title    string `xml:"title"`
+			Subject  string `xml:"subject"`
+			Creator  string `xml:"creator"`
+			Keywords string `xml:"keywords"`
+		}
+		if err := xml.Unmarshal(data, &core); err == nil {
+			doc.Props = Properties{Title: core.Title, Author: core.Creator, Subject: core.Subject, Keywords: core.Keywords}
+		}
+	}
+
+	var out []rune
+	add := func(tag, value string, start, end int) {
+		// A run formatted like the one before continues its span
+		for i := len(doc.Tags) - 1; i >= 0 && doc.Tags[i].End == start; i-- {
+			if doc.Tags[i].Tag == tag && doc.Tags[i].Value == value {
+				doc.Tags[i].End = end
+				return
+			}
+		}
+		doc.Tags = append(doc.Tags, TagSpan{Tag: tag, Start: start, End: end, Value: value})
+	}
+	var bold, italic bool
+	var size, link string
+	inPPr, inRPr, inText, center, sectionBreak := false, false, false, false, false
+	paras, paraStart, fallback := 0, 0, 0
+	text := func(s string) {
+		start := len(out)
+		out = append(out, []rune(s)...)
+		if start == len(out) {
+			return
+		}
+		if bold {
+			add("bold", "", start, len(out))
+		}
+		if italic {
+			add("italic", "", start, len(out))
+		}
+		if size != "" {
+			add("size", size, start, len(out))
+		}
+		if link != "" {
+			add("link", link, start, len(out))
+		}
+	}
+	on := func(el xml.StartElement) bool {
+		for _, attr := range el.Attr {
+			if attr.Name.Local == "val" {
+				return attr.Value != "0" && attr.Value != "false" && attr.Value != "off"
+			}
+		}
+		return true
+	}
+	attr := func(el xml.StartElement, name string) string {
+		for _, attr := range el.Attr {
+			if attr.Name.Local == name {
+				return attr.Value
+			}
+		}
+		return ""
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			// Older copies of drawings and text boxes repeat their text
+			if t.Name.Local == "Fallback" {
+				fallback++
+			}
+			if fallback > 0 || t.Name.Space != docxWordNS {
+				continue
+			}
+			switch t.Name.Local {
+			case "p":
+				if paras > 0 {
+					out = append(out, '\n')
+				}
+				paras++
+				paraStart, center, sectionBreak = len(out), false, false
+			case "pPr":
+				inPPr = true
+			case "rPr":
+				inRPr = true
+			case "r":
+				bold, italic, size = false, false, ""
+			case "b", "i", "sz":
+				// Formatting of the paragraph mark is not the text's
+				if !inRPr || inPPr {
+					continue
+				}
+				switch t.Name.Local {
+				case "b":
+					bold = on(t)
+				case "i":
+					italic = on(t)
+				default:
+					// Half-points; 12 pt is the editor's normal size, not a size tag
+					size = ""
+					if half, err := strconv.ParseFloat(attr(t, "val"), 64); err == nil && half != 24 {
+						size = strconv.FormatFloat(half/2, 'f', -1, 64)
+					}
+				}
+			case "jc":
+				if inPPr {
+					center = attr(t, "val") == "center"
+				}
+			case "sectPr":
+				sectionBreak = inPPr
+			case "hyperlink":
+				link = links[attr(t, "id")]
+			case "t":
+				inText = true
+			case "tab":
+				if !inPPr {
+					text("\t")
+				}
+			case "br", "cr":
+				text("\n")
+			}
+		case xml.EndElement:
+			if t.Name.Local == "Fallback" {
+				fallback--
+			}
+			if fallback > 0 || t.Name.Space != docxWordNS {
+				continue
+			}
+			switch t.Name.Local {
+			case "p":
+				if sectionBreak && paraStart == len(out) {
+					// An empty paragraph ending a section, as combined merges write
+					out = append(out, []rune(pageBreak)...)
+				}
+				if center && paraStart < len(out) {
+					add("center", "", paraStart, len(out))
+				}
+			case "pPr":
+				inPPr = false
+			case "rPr":
+				inRPr = false
+			case "hyperlink":
+				link = ""
+			case "t":
+				inText = false
+			}
+		case xml.CharData:
+			if inText && fallback == 0 {
+				text(string(t))
+			}
+		}
+	}
+	doc.Text = string(out)
+	sort.Slice(doc.Tags, func(i, j int) bool { return doc.Tags[i].Start < doc.Tags[j].Start })
+	return doc, nil
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '&':
+			b.WriteString("&amp;")
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '"':
+			b.WriteString("&quot;")
+		case '\'':
+			b.WriteString("&apos;")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gotk3/gotk3/glib"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// What a dry run finds wrong with a record
+const (
+	issueEmpty = "empty field"    // a required field is blank
+	issueName  = "duplicate name" // the output name is taken, so gets a suffix
+	issueDate  = "invalid date"   // a date column or {{date}} value cannot be read
+	issueError = "error"          // the record would fail to merge
+)
+
+// Actions that open or close a block, whose fields are only sometimes
+// used or belong to something other than the record
+var mergeBlockWords = map[string]bool{
+	"if": true, "else": true, "end": true, "range": true, "with": true,
+	"define": true, "block": true, "template": true,
+}
+
+// DryRunIssue is something wrong with one record
+type DryRunIssue struct {
+	Record  int
+	Key     string
+	Kind    string
+	Message string
+}
+
+// DryRunReport is what a merge would run into, found without writing or
+// sending anything
+type DryRunReport struct {
+	Total    int      // records the merge would read
+	Unknown  []string // fields the templates use that are not columns
+	Unused   []string // columns no template uses
+	Required []string // fields always printed, so a blank one shows
+	Issues   []DryRunIssue
+}
+
+// Counts by kind of issue
+func (r *DryRunReport) Counts() map[string]int {
+	counts := map[string]int{}
+	for _, issue := range r.Issues {
+		counts[issue.Kind]++
+	}
+	return counts
+}
+
+// Summary is one line for the log or a dialog
+func (r *DryRunReport) Summary() string {
+	var parts []string
+	if len(r.Unknown) > 0 {
+		parts = append(parts, plural(len(r.Unknown), "unknown field"))
+	}
+	counts := r.Counts()
+	for _, kind := range []string{issueEmpty, issueName, issueDate, issueError} {
+		if counts[kind] > 0 {
+			parts = append(parts, plural(counts[kind], kind))
+		}
+	}
+	if len(parts) == 0 {
+		return fmt.Sprintf("Checked %d records: no problems found", r.Total)
+	}
+	return fmt.Sprintf("Checked %d records: %s", r.Total, strings.Join(parts, ", "))
+}
+
+// Fields describes the template's fields, a line for each kind
+func (r *DryRunReport) Fields() []string {
+	var lines []string
+	if len(r.Unknown) > 0 {
+		lines = append(lines, "Unknown fields: {{"+strings.Join(r.Unknown, "}}, {{")+"}}")
+	}
+	if len(r.Unused) > 0 {
+		lines = append(lines, "Unused fields: "+strings.Join(r.Unused, ", "))
+	}
+	if len(r.Required) > 0 {
+		lines = append(lines, "Required fields: "+strings.Join(r.Required, ", "))
+	}
+	return lines
+}
+
+// ExitCode for batch mode: failed if records would fail or fields are
+// unknown, partial if some records only have warnings
+func (r *DryRunReport) ExitCode() int {
+	counts := r.Counts()
+	switch {
+	case len(r.Unknown) > 0 || counts[issueError] > 0 || counts[issueDate] > 0:
+		return exitFailed
+	case len(r.Issues) > 0:
+		return exitPartial
+	}
+	return exitOK
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return strconv.Itoa(n) + " " + noun + "s"
+}
+
+// fieldUsage gathers what merge templates do with the fields
+type fieldUsage struct {
+	columns  []string
+	used     map[string]bool
+	unknown  []string
+	required []string
+	dates    map[string]bool // columns given to {{date}}
+	seen     map[string]bool
+}
+
+func newFieldUsage(columns []string) *fieldUsage {
+	return &fieldUsage{columns: columns, used: map[string]bool{}, dates: map[string]bool{}, seen: map[string]bool{}}
+}
+
+// scan notes the fields of one template. Fields inside {{if}} or
+// {{range}} and those given a default are not required, and fields
+// inside {{range}} or {{with}} belong to what they loop over, so are
+// not checked.
+func (u *fieldUsage) scan(text string) {
+	known := map[string]bool{}
+	for _, col := range u.columns {
+		known[col] = true
+	}
+	var blocks []string
+	for _, f := range findMergeFields(text) {
+		if known[f.Name] {
+			u.use(f.Name, len(blocks) == 0)
+			continue
+		}
+		if !mergeAction(f.Name) {
+			u.unknownField(f.Name)
+			continue
+		}
+		action := strings.TrimSpace(strings.Trim(strings.TrimSpace(f.Name), "-"))
+		words := strings.FieldsFunc(action, func(r rune) bool {
+			return unicode.IsSpace(r) || r == '|' || r == '('
+		})
+		word := ""
+		if len(words) > 0 {
+			word = words[0]
+		}
+		if word == "end" {
+			if len(blocks) > 0 {
+				blocks = blocks[:len(blocks)-1]
+			}
+			continue
+		}
+		rebound := false
+		for _, b := range blocks {
+			rebound = rebound || b != "if"
+		}
+		if !rebound {
+			required := len(blocks) == 0 && !mergeBlockWords[word]
+			date := false
+			for _, w := range words {
+				required = required && w != "default"
+				date = date || w == "date"
+			}
+			for _, name := range templateFields(action) {
+				cols := u.fieldColumns(name)
+				if len(cols) == 0 {
+					u.unknownField(name)
+				}
+				for _, col := range cols {
+					u.use(col, required && col == name)
+					u.dates[col] = u.dates[col] || (date && col == name)
+				}
+			}
+		}
+		switch word {
+		case "if", "range", "with", "define", "block":
+			blocks = append(blocks, word)
+		}
+	}
+}
+
+// The columns a template name refers to: the column itself, a list
+// column name[], or the nested columns name.*
+func (u *fieldUsage) fieldColumns(name string) []string {
+	var cols []string
+	for _, col := range u.columns {
+		if col == name || col == name+jsonListSuffix || strings.HasPrefix(col, name+".") {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+func (u *fieldUsage) use(col string, required bool) {
+	u.used[col] = true
+	if required && !u.seen["required:"+col] {
+		u.seen["required:"+col] = true
+		u.required = append(u.required, col)
+	}
+}
+
+func (u *fieldUsage) unknownField(name string) {
+	if !u.seen["unknown:"+name] {
+		u.seen["unknown:"+name] = true
+		u.unknown = append(u.unknown, name)
+	}
+}
+
+// dryRunMerge goes through job as mailMerge would, record by record,
+// merging each in memory, and reports what would go wrong: unknown and
+// unused fields, blank required fields, output names that clash, dates
+// that cannot be read and anything else that would fail a record.
+// Nothing is written or sent.
+func dryRunMerge(ctx context.Context, db *sql.DB, job MergeJob) (*DryRunReport, error) {
+	printed := job.Labels != nil || job.Envelope != nil
+	combined := job.Combined || printed
+	source, err := loadMergeTemplate(job.Template)
+	if err != nil {
+		return nil, fmt.Errorf("reading template: %w", err)
+	}
+	data, query, args, done, err := mergeSource(db, &job)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	rows, err := data.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", job.Table, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", job.Table, err)
+	}
+
+	tmpl, err := newMergeTemplate(source, columns)
+	if err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	ext := job.Extension
+	if ext == "" {
+		ext = mergeOutputExt(job.Template)
+	}
+	var email *EmailTemplate
+	if job.Email != nil {
+		if email, err = newEmailTemplate(*job.Email, columns, filepath.Dir(job.Template)); err != nil {
+			return nil, err
+		}
+		ext = emailExtension
+	}
+	namer, err := newOutputNamer(job.NamePattern, ext, columns)
+	if err != nil {
+		return nil, err
+	}
+	manifest := job.Manifest
+	if manifest == "" {
+		manifest = filepath.Join(job.Output, defaultManifest)
+	}
+	if filepath.Dir(manifest) == filepath.Clean(job.Output) {
+		namer.Reserve(filepath.Base(manifest))
+	}
+	// Only records written to files of their own are named
+	named := !combined && job.SMTP == nil
+
+	usage := newFieldUsage(columns)
+	usage.scan(source.Text)
+	if named {
+		usage.scan(namer.pattern)
+	}
+	if job.Email != nil {
+		for _, text := range []string{job.Email.From, job.Email.To, job.Email.Cc, job.Email.Subject, job.Email.Attachments} {
+			usage.scan(text)
+		}
+	}
+	report := &DryRunReport{Unknown: usage.unknown, Required: usage.required}
+	for _, col := range columns {
+		if !usage.used[col] {
+			report.Unused = append(report.Unused, col)
+		}
+	}
+
+	// Dates to check in every record: used columns declared as dates,
+	// and whatever goes through {{date}}. The types come from rows, as
+	// a data file's database has no connection to spare for another query.
+	types := map[string]string{}
+	if colTypes, err := rows.ColumnTypes(); err == nil {
+		for _, t := range colTypes {
+			types[t.Name()] = t.DatabaseTypeName()
+		}
+	}
+	var dateCols []int
+	for i, col := range columns {
+		t := strings.ToUpper(types[col])
+		if usage.used[col] && (usage.dates[col] || strings.Contains(t, "DATE") || strings.Contains(t, "TIME")) {
+			dateCols = append(dateCols, i)
+		}
+	}
+	// Records are rendered with the unknown fields blank, so they are
+	// reported once above rather than stopping every record
+	renderCols := append(append([]string{}, columns...), usage.unknown...)
+
+	// Which record first took each output name
+	owners := map[string]int{}
+	for n := 1; ctx.Err() == nil && rows.Next(); n++ {
+		report.Total++
+		issue := func(key, kind, message string) {
+			report.Issues = append(report.Issues, DryRunIssue{Record: n, Key: key, Kind: kind, Message: message})
+		}
+		vals, err := scanRecord(rows, len(columns))
+		if err != nil {
+			issue(strconv.Itoa(n), issueError, err.Error())
+			continue
+		}
+		key := recordKey(columns, vals, n)
+		renderVals := append(append([]string{}, vals...), make([]string, len(usage.unknown))...)
+		for _, i := range dateCols {
+			value := strings.TrimSpace(vals[i])
+			if value == "" {
+				continue
+			}
+			if _, err := parseDate(value); err != nil {
+				issue(key, issueDate, columns[i]+": "+err.Error())
+				// Blank, so rendering goes on to find any other problem
+				renderVals[i] = ""
+			}
+		}
+		var empty []string
+		for _, col := range usage.required {
+			for i, c := range columns {
+				if c == col && strings.TrimSpace(vals[i]) == "" {
+					empty = append(empty, col)
+				}
+			}
+		}
+		switch len(empty) {
+		case 0:
+		case 1:
+			issue(key, issueEmpty, empty[0]+" is empty")
+		default:
+			issue(key, issueEmpty, strings.Join(empty, ", ")+" are empty")
+		}
+		if named {
+			if wanted, err := namer.Wanted(renderCols, renderVals); err != nil {
+				issue(key, issueError, err.Error())
+			} else {
+				name, _ := namer.Name(renderCols, renderVals)
+				if name != wanted {
+					taker := "the manifest"
+					if first, ok := owners[strings.ToLower(wanted)]; ok {
+						taker = "record " + strconv.Itoa(first)
+					}
+					issue(key, issueName, fmt.Sprintf("%s is taken by %s; written as %s", wanted, taker, name))
+				}
+				owners[strings.ToLower(name)] = n
+			}
+		}
+		doc, err := tmpl.Merge(renderCols, renderVals)
+		if err == nil && email != nil {
+			_, _, err = email.Message(renderCols, renderVals, doc)
+		}
+		if err != nil {
+			issue(key, issueError, err.Error())
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", job.Table, err)
+	}
+	return report, nil
+}
+
+// Show what a dry run found: the fields, then each record's issues
+func dryRunDialog(parent *gtk.Window, report *DryRunReport) {
+	dialog, err := gtk.DialogNew()
+	if err != nil {
+		log.Fatal("Unable to create dialog:", err)
+	}
+	dialog.SetTitle("Mail Merge Validation")
+	dialog.SetTransientFor(parent)
+	dialog.SetModal(true)
+	dialog.SetDefaultSize(500, 300)
+	dialog.AddButton("Close", gtk.RESPONSE_CLOSE)
+
+	vbox, err := dialog.GetContentArea()
+	if err != nil {
+		log.Fatal("Unable to get content area:", err)
+	}
+	label, err := gtk.LabelNew(strings.Join(append([]string{report.Summary()}, report.Fields()...), "\n"))
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	label.SetXAlign(0)
+	label.SetSelectable(true)
+	label.SetLineWrap(true)
+	vbox.PackStart(label, false, false, 5)
+
+	if len(report.Issues) > 0 {
+		titles := []string{"Record", "Key", "Problem", "Detail"}
+		types := make([]glib.Type, len(titles))
+		for i := range types {
+			types[i] = glib.TYPE_STRING
+		}
+		store, err := gtk.ListStoreNew(types...)
+		if err != nil {
+			log.Fatal("Unable to create list store:", err)
+		}
+		for _, issue := range report.Issues {
+			iter := store.Append()
+			for i, val := range []string{strconv.Itoa(issue.Record), issue.Key, issue.Kind, issue.Message} {
+				store.SetValue(iter, i, val)
+			}
+		}
+		treeView, err := gtk.TreeViewNewWithModel(store)
+		if err != nil {
+			log.Fatal("Unable to create tree view:", err)
+		}
+		for i, title := range titles {
+			renderer, err := gtk.CellRendererTextNew()
+			if err != nil {
+				log.Fatal("Unable to create cell renderer:", err)
+			}
+			column, err := gtk.TreeViewColumnNewWithAttribute(title, renderer, "text", i)
+			if err != nil {
+				log.Fatal("Unable to create tree view column:", err)
+			}
+			column.SetResizable(true)
+			treeView.AppendColumn(column)
+		}
+		scrolled, err := gtk.ScrolledWindowNew(nil, nil)
+		if err != nil {
+			log.Fatal("Unable to create scrolled window:", err)
+		}
+		scrolled.SetPolicy(gtk.POLICY_AUTOMATIC, gtk.POLICY_AUTOMATIC)
+		scrolled.Add(treeView)
+		vbox.PackStart(scrolled, true, true, 5)
+	}
+	vbox.ShowAll()
+	dialog.Run()
+	dialog.Destroy()
+}
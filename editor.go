@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// Editor ties the main text view to the features that keep state about
+// its buffer (tracked changes, comments, links, ...), so save and open can
+// capture and restore all of it.
+type Editor struct {
+	window   *gtk.Window
+	textView *gtk.TextView
+	buffer   *gtk.TextBuffer
+	tagTable *gtk.TextTagTable
+	tracker  *Tracker
+	comments *Comments
+	links    *Links
+	fields   *MergeFields
+	props    Properties
+	format   TextFormat // encoding and line endings for plain text saves
+	readOnly bool
+	loading  bool // a file is being streamed in
+}
+
+func newEditor(window *gtk.Window, textView *gtk.TextView, buffer *gtk.TextBuffer, commentsPanel *gtk.Box) *Editor {
+	tagTable, err := buffer.GetTagTable()
+	if err != nil {
+		log.Fatal("Unable to get tag table:", err)
+	}
+	ed := &Editor{
+		window:   window,
+		textView: textView,
+		buffer:   buffer,
+		tagTable: tagTable,
+		format:   defaultTextFormat,
+	}
+	ed.tracker = newTracker(buffer, tagTable)
+	ed.links = newLinks(buffer, tagTable)
+	ed.comments = newComments(window, buffer, tagTable, commentsPanel, func() string { return ed.tracker.Author })
+	setupLinkClicks(ed)
+	setupClipboard(ed)
+	return ed
+}
+
+// Document captures the buffer text, formatting and review state
+func (e *Editor) Document() *Document {
+	start, end := e.buffer.GetBounds()
+	text, _ := e.buffer.GetText(start, end, true)
+	doc := &Document{Props: e.props, Text: text}
+	for _, name := range formatTags {
+		tag, err := e.tagTable.Lookup(name)
+		if err != nil {
+			continue
+		}
+		value := ""
+		if name == "size" {
+			if size, err := tag.GetProperty("size-points"); err == nil {
+				value = strconv.FormatFloat(size.(float64), 'f', -1, 64)
+			}
+		}
+		for _, r := range tagRanges(e.buffer, tag) {
+			doc.Tags = append(doc.Tags, TagSpan{Tag: name, Start: r[0], End: r[1], Value: value})
+		}
+	}
+	doc.Tags = append(doc.Tags, e.links.Spans()...)
+	doc.Changes = e.tracker.Changes()
+	doc.Comments = e.comments.Comments()
+	return doc
+}
+
+// LoadDocument replaces the buffer contents with doc
+func (e *Editor) LoadDocument(doc *Document) {
+	e.SetText(doc.Text)
+	e.SetReadOnly(false)
+	e.props = doc.Props
+	for _, span := range doc.Tags {
+		if span.Tag == "link" {
+			e.links.Add(e.buffer.GetIterAtOffset(span.Start), e.buffer.GetIterAtOffset(span.End), span.Value)
+			continue
+		}
+		tag, err := e.tagTable.Lookup(span.Tag)
+		if err != nil {
+			log.Println("Unknown tag:", span.Tag)
+			continue
+		}
+		if span.Tag == "size" && span.Value != "" {
+			if size, err := strconv.ParseFloat(span.Value, 64); err == nil {
+				tag.SetProperty("size-points", size)
+			}
+		}
+		e.buffer.ApplyTag(tag, e.buffer.GetIterAtOffset(span.Start), e.buffer.GetIterAtOffset(span.End))
+	}
+	e.tracker.Restore(doc.Changes)
+	e.comments.Restore(doc.Comments)
+}
+
+// InsertDocument inserts the text and formatting of doc at offset, as a
+// paste would. Review state and properties in doc are ignored.
+func (e *Editor) InsertDocument(offset int, doc *Document) {
+	e.buffer.Insert(e.buffer.GetIterAtOffset(offset), doc.Text)
+	for _, span := range doc.Tags {
+		start := e.buffer.GetIterAtOffset(offset + span.Start)
+		end := e.buffer.GetIterAtOffset(offset + span.End)
+		if span.Tag == "link" {
+			e.links.Add(start, end, span.Value)
+			continue
+		}
+		// The size tag is shared, so pasted text takes the current size
+		if tag, err := e.tagTable.Lookup(span.Tag); err == nil {
+			e.buffer.ApplyTag(tag, start, end)
+		}
+	}
+}
+
+// SetText replaces the buffer contents, dropping review state and
+// properties, without recording a tracked change
+func (e *Editor) SetText(text string) {
+	e.tracker.Reset()
+	e.comments.Reset()
+	e.links.Reset()
+	e.props = Properties{}
+	e.format = defaultTextFormat
+	e.tracker.busy = true
+	e.buffer.SetText(text)
+	e.tracker.busy = false
+}
+
+// SetReadOnly stops or allows editing, as for large files
+func (e *Editor) SetReadOnly(readOnly bool) {
+	e.readOnly = readOnly
+	e.textView.SetEditable(!readOnly)
+}
+
+// Character offset ranges covered by tag
+func tagRanges(buffer *gtk.TextBuffer, tag *gtk.TextTag) [][2]int {
+	var ranges [][2]int
+	iter := buffer.GetStartIter()
+	for {
+		if !iter.HasTag(tag) && !iter.ForwardToTagToggle(tag) {
+			return ranges
+		}
+		start := iter.GetOffset()
+		iter.ForwardToTagToggle(tag)
+		ranges = append(ranges, [2]int{start, iter.GetOffset()})
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// Email merges write one .eml per record, or merged.mbox when combined
+const (
+	emailExtension = "eml"
+	mboxExtension  = ".mbox"
+)
+
+// EmailOptions turn a merge into email. Each is a merge template, like
+// the file name pattern, so {{.Email}} or {{Email}} binds to a column.
+type EmailOptions struct {
+	From    string
+	To      string // one or more addresses, comma separated
+	Cc      string
+	Subject string
+	// Files to attach, separated by commas, semicolons or new lines.
+	// Relative paths are from the template's folder.
+	Attachments string
+}
+
+// EmailTemplate builds the messages of an email merge
+type EmailTemplate struct {
+	from, to, cc, subject, attachments *template.Template
+	dir                                string // for relative attachment paths
+}
+
+func newEmailTemplate(opts EmailOptions, columns []string, dir string) (*EmailTemplate, error) {
+	e := &EmailTemplate{dir: dir}
+	for _, field := range []struct {
+		name, text string
+		tmpl       **template.Template
+	}{
+		{"From", opts.From, &e.from},
+		{"To", opts.To, &e.to},
+		{"Cc", opts.Cc, &e.cc},
+		{"Subject", opts.Subject, &e.subject},
+		{"Attachments", opts.Attachments, &e.attachments},
+	} {
+		tmpl, err := parseMergeTemplate(field.text, columns)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field.name, err)
+		}
+		*field.tmpl = tmpl
+	}
+	if strings.TrimSpace(opts.From) == "" {
+		return nil, fmt.Errorf("email needs a From address")
+	}
+	if strings.TrimSpace(opts.To) == "" {
+		return nil, fmt.Errorf("email needs a To address")
+	}
+	return e, nil
+}
+
+// Message builds the RFC 5322 message for one record, with doc as a
+// plain text and an HTML body, and the envelope to send it in
+func (e *EmailTemplate) Message(columns, values []string, doc *Document) ([]byte, Envelope, error) {
+	var env Envelope
+	msg, err := e.message(columns, values, doc, &env)
+	return msg, env, err
+}
+
+func (e *EmailTemplate) message(columns, values []string, doc *Document, env *Envelope) ([]byte, error) {
+	field := func(name string, tmpl *template.Template) (string, error) {
+		s, err := mergeRecord(tmpl, columns, values)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		// Header values are one line
+		return strings.Join(strings.Fields(s), " "), nil
+	}
+	addresses := func(name string, tmpl *template.Template, required bool) ([]*mail.Address, error) {
+		s, err := field(name, tmpl)
+		if err != nil || s == "" && !required {
+			return nil, err
+		}
+		list, err := mail.ParseAddressList(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q: %w", name, s, err)
+		}
+		return list, nil
+	}
+	from, err := addresses("From", e.from, true)
+	if err != nil {
+		return nil, err
+	}
+	to, err := addresses("To", e.to, true)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := addresses("Cc", e.cc, false)
+	if err != nil {
+		return nil, err
+	}
+	subject, err := field("Subject", e.subject)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := mergeRecord(e.attachments, columns, values)
+	if err != nil {
+		return nil, fmt.Errorf("Attachments: %w", err)
+	}
+	var files []string
+	for _, name := range strings.FieldsFunc(attachments, func(r rune) bool {
+		return r == ',' || r == ';' || r == '\n' || r == '\r'
+	}) {
+		if name = strings.TrimSpace(name); name != "" {
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(e.dir, name)
+			}
+			files = append(files, name)
+		}
+	}
+
+	env.From = from[0].Address
+	for _, addr := range append(to, cc...) {
+		env.To = append(env.To, addr.Address)
+	}
+
+	var b bytes.Buffer
+	writeAddressHeader(&b, "From", from)
+	writeAddressHeader(&b, "To", to)
+	if len(cc) > 0 {
+		writeAddressHeader(&b, "Cc", cc)
+	}
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: %s\r\n", messageID(from[0].Address))
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	// The title of the HTML body is the subject
+	page := *doc
+	page.Props.Title = subject
+	var alt bytes.Buffer
+	altWriter := multipart.NewWriter(&alt)
+	for _, body := range []struct{ contentType, text string }{
+		{"text/plain; charset=utf-8", doc.FinalText()},
+		{"text/html; charset=utf-8", documentHTML(&page)},
+	} {
+		part, err := altWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {body.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(part)
+		if _, err := qp.Write([]byte(strings.ReplaceAll(body.text, "\n", "\r\n"))); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := altWriter.Close(); err != nil {
+		return nil, err
+	}
+	altType := "multipart/alternative; boundary=" + altWriter.Boundary()
+	if len(files) == 0 {
+		b.WriteString("Content-Type: " + altType + "\r\n\r\n")
+		b.Write(alt.Bytes())
+		return b.Bytes(), nil
+	}
+
+	// Attachments go alongside the bodies in multipart/mixed
+	var mixed bytes.Buffer
+	mixedWriter := multipart.NewWriter(&mixed)
+	part, err := mixedWriter.CreatePart(textproto.MIMEHeader{"Content-Type": {altType}})
+	if err != nil {
+		return nil, err
+	}
+	part.Write(alt.Bytes())
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("attachment: %w", err)
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		part, err := mixedWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(name)})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Base64 in lines of 76 characters
+		encoded := base64.StdEncoding.EncodeToString(data)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+	if err := mixedWriter.Close(); err != nil {
+		return nil, err
+	}
+	b.WriteString("Content-Type: multipart/mixed; boundary=" + mixedWriter.Boundary() + "\r\n\r\n")
+	b.Write(mixed.Bytes())
+	return b.Bytes(), nil
+}
+
+// Write an address header, folding long lists one address to a line
+func writeAddressHeader(b *bytes.Buffer, name string, list []*mail.Address) {
+	addrs := make([]string, len(list))
+	for i, addr := range list {
+		addrs[i] = addr.String()
+	}
+	line := strings.Join(addrs, ", ")
+	if len(name)+2+len(line) > 78 {
+		line = strings.Join(addrs, ",\r\n ")
+	}
+	fmt.Fprintf(b, "%s: %s\r\n", name, line)
+}
+
+// The bare address in s, such as me@example.com from Me <me@example.com>
+func mailAddress(s string) (string, error) {
+	addr, err := mail.ParseAddress(s)
+	if err != nil {
+		return "", err
+	}
+	return addr.Address, nil
+}
+
+// A unique Message-ID in the sender's domain
+func messageID(from string) string {
+	domain := "goatpad.invalid"
+	if at := strings.LastIndex(from, "@"); at >= 0 && at+1 < len(from) {
+		domain = from[at+1:]
+	}
+	random := make([]byte, 8)
+	rand.Read(random)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(random), domain)
+}
+
+// mbox holds messages in one file for review in a mail client. Lines
+// are LF terminated, each message starts with a From_ line, and body
+// lines that look like one are quoted with > (mboxrd).
+func mbox(messages [][]byte) []byte {
+	var b bytes.Buffer
+	stamp := time.Now().UTC().Format(time.ANSIC)
+	for _, msg := range messages {
+		fmt.Fprintf(&b, "From MAILER-DAEMON %s\n", stamp)
+		text := strings.ReplaceAll(string(msg), "\r\n", "\n")
+		for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+			if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				b.WriteByte('>')
+			}
+			b.WriteString(line + "\n")
+		}
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// EmailForm sets the email options in the mail merge dialog, and the
+// SMTP server to send through
+type EmailForm struct {
+	Expander  *gtk.Expander
+	check     *gtk.CheckButton
+	entries   []*gtk.Entry // From, To, Cc, Subject, Attachments
+	sendCheck *gtk.CheckButton
+	server    *gtk.Entry
+	security  *gtk.ComboBoxText
+	username  *gtk.Entry
+	password  *gtk.Entry
+	auth      *gtk.ComboBoxText
+	rate      *gtk.SpinButton
+	testTo    *gtk.Entry
+}
+
+func newEmailForm(changed func()) *EmailForm {
+	f := &EmailForm{}
+	var err error
+	f.Expander, err = gtk.ExpanderNew("Email")
+	if err != nil {
+		log.Fatal("Unable to create expander:", err)
+	}
+	grid, err := gtk.GridNew()
+	if err != nil {
+		log.Fatal("Unable to create grid:", err)
+	}
+	grid.SetRowSpacing(5)
+	grid.SetColumnSpacing(5)
+	row := 0
+	attach := func(text string, widget gtk.IWidget) {
+		label, err := gtk.LabelNew(text)
+		if err != nil {
+			log.Fatal("Unable to create label:", err)
+		}
+		label.SetXAlign(0)
+		grid.Attach(label, 0, row, 1, 1)
+		grid.Attach(widget, 1, row, 1, 1)
+		row++
+	}
+	entry := func(text, placeholder string) *gtk.Entry {
+		entry, err := gtk.EntryNew()
+		if err != nil {
+			log.Fatal("Unable to create entry:", err)
+		}
+		entry.SetPlaceholderText(placeholder)
+		entry.SetHExpand(true)
+		attach(text, entry)
+		return entry
+	}
+	combo := func(text string, options ...string) *gtk.ComboBoxText {
+		combo, err := gtk.ComboBoxTextNew()
+		if err != nil {
+			log.Fatal("Unable to create combo box:", err)
+		}
+		for i := 0; i+1 < len(options); i += 2 {
+			combo.Append(options[i], options[i+1])
+		}
+		combo.SetActive(0)
+		attach(text, combo)
+		return combo
+	}
+
+	f.check, err = gtk.CheckButtonNewWithLabel("Write email messages: an .eml per record, or one .mbox when combined")
+	if err != nil {
+		log.Fatal("Unable to create check button:", err)
+	}
+	grid.Attach(f.check, 0, row, 2, 1)
+	row++
+	f.entries = []*gtk.Entry{
+		entry("From:", "Name <me@example.com>"),
+		entry("To:", "{{.Email}}"),
+		entry("Cc:", ""),
+		entry("Subject:", "Hello {{.Name}}"),
+		entry("Attachments:", "{{.Invoice}}; brochure.pdf"),
+	}
+	f.entries[4].SetTooltipText("Files to attach, separated by ; or commas. Relative paths are from the template's folder.")
+
+	// Sending
+	f.sendCheck, err = gtk.CheckButtonNewWithLabel("Send now through an SMTP server instead of writing files")
+	if err != nil {
+		log.Fatal("Unable to create check button:", err)
+	}
+	grid.Attach(f.sendCheck, 0, row, 2, 1)
+	row++
+	f.server = entry("Server:", "smtp.example.com:587")
+	f.security = combo("Security:", securitySTARTTLS, "STARTTLS", securityTLS, "TLS", securityNone, "None (local testing)")
+	f.username = entry("User Name:", "none")
+	f.password = entry("Password:", "")
+	f.password.SetVisibility(false)
+	f.auth = combo("Sign In With:", "plain", "PLAIN", "login", "LOGIN")
+	f.rate, err = gtk.SpinButtonNewWithRange(0, 6000, 1)
+	if err != nil {
+		log.Fatal("Unable to create spin button:", err)
+	}
+	f.rate.SetValue(30)
+	f.rate.SetTooltipText("0 for no limit")
+	attach("Messages a Minute:", f.rate)
+	f.testTo = entry("Test Address:", "everything goes here instead, for a dry run")
+
+	f.Expander.Add(grid)
+	f.check.Connect("toggled", func() {
+		f.update()
+		changed()
+	})
+	f.sendCheck.Connect("toggled", f.update)
+	f.update()
+	return f
+}
+
+// Only the options in use can be edited
+func (f *EmailForm) update() {
+	email, send := f.check.GetActive(), f.check.GetActive() && f.sendCheck.GetActive()
+	for _, entry := range f.entries {
+		entry.SetSensitive(email)
+	}
+	f.sendCheck.SetSensitive(email)
+	for _, w := range []interface{ SetSensitive(bool) }{f.server, f.security, f.username, f.password, f.auth, f.rate, f.testTo} {
+		w.SetSensitive(send)
+	}
+}
+
+// Options as entered, or nil when not merging to email
+func (f *EmailForm) Options() *EmailOptions {
+	if !f.check.GetActive() {
+		return nil
+	}
+	values := make([]string, len(f.entries))
+	for i, entry := range f.entries {
+		values[i] = entryText(entry)
+	}
+	return &EmailOptions{From: values[0], To: values[1], Cc: values[2], Subject: values[3], Attachments: values[4]}
+}
+
+// SMTP settings as entered, or nil when not sending
+func (f *EmailForm) SMTP() *SMTPOptions {
+	if !f.check.GetActive() || !f.sendCheck.GetActive() {
+		return nil
+	}
+	// Spaces may be part of a password
+	password, err := f.password.GetText()
+	if err != nil {
+		log.Println("Get text error:", err)
+	}
+	return &SMTPOptions{
+		Server:      entryText(f.server),
+		Security:    f.security.GetActiveID(),
+		Username:    entryText(f.username),
+		Password:    password,
+		Auth:        f.auth.GetActiveID(),
+		Rate:        f.rate.GetValue(),
+		Retries:     3,
+		TestAddress: entryText(f.testTo),
+	}
+}
+
+func entryText(entry *gtk.Entry) string {
+	text, err := entry.GetText()
+	if err != nil {
+		log.Println("Get text error:", err)
+	}
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encodings plain text files can be read and written in
+const (
+	encUTF8    = "UTF-8"
+	encUTF8BOM = "UTF-8 BOM"
+	encUTF16LE = "UTF-16LE"
+	encUTF16BE = "UTF-16BE"
+	encCP1252  = "Windows-1252"
+	encLatin1  = "ISO-8859-1"
+)
+
+var encodings = []string{encUTF8, encUTF8BOM, encUTF16LE, encUTF16BE, encCP1252, encLatin1}
+
+// Line ending styles
+const (
+	eolLF   = "LF"
+	eolCRLF = "CRLF"
+	eolCR   = "CR"
+)
+
+var lineEndings = []string{eolLF, eolCRLF, eolCR}
+
+// TextFormat is how a plain text file was stored, so it can be written
+// back the same way.
+type TextFormat struct {
+	Encoding   string
+	LineEnding string
+}
+
+var defaultTextFormat = TextFormat{encUTF8, eolLF}
+
+// detectEncoding guesses the encoding of data from its byte order mark,
+// the pattern of zero bytes typical of UTF-16, or whether it is valid
+// UTF-8. Anything else is taken as Windows-1252, or Latin-1 when it has
+// none of the characters the two disagree on.
+func detectEncoding(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return encUTF8BOM
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return encUTF16LE
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return encUTF16BE
+	}
+	// Mostly-ASCII UTF-16 has a zero in every other byte
+	if len(data) >= 4 && len(data)%2 == 0 {
+		evenZeros, oddZeros := 0, 0
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 {
+				evenZeros++
+			}
+			if data[i+1] == 0 {
+				oddZeros++
+			}
+		}
+		pairs := len(data) / 2
+		if oddZeros > pairs*3/4 && evenZeros == 0 {
+			return encUTF16LE
+		}
+		if evenZeros > pairs*3/4 && oddZeros == 0 {
+			return encUTF16BE
+		}
+	}
+	if utf8.Valid(data) {
+		return encUTF8
+	}
+	for _, b := range data {
+		if b >= 0x80 && b < 0xA0 {
+			return encCP1252
+		}
+	}
+	return encLatin1
+}
+
+// decodeText converts data to UTF-8 with LF line endings and reports the
+// format it was in. enc overrides detection unless empty.
+func decodeText(data []byte, enc string) (string, TextFormat, error) {
+	if enc == "" {
+		enc = detectEncoding(data)
+	}
+	d := &textDecoder{Encoding: enc}
+	text, err := d.Decode(data, true)
+	if err != nil {
+		return "", TextFormat{}, err
+	}
+	return text, d.Format(), nil
+}
+
+// textDecoder decodes a file piece by piece, so large files can be
+// streamed into the editor. Bytes that end mid-character, and a CR that
+// may be the first half of a CRLF, are held back for the next piece.
+type textDecoder struct {
+	Encoding     string
+	started      bool   // byte order mark dealt with
+	pending      []byte // undecoded bytes from the last piece
+	carry        string // trailing CR from the last piece
+	crlf, cr, lf int    // line endings seen so far
+}
+
+// Decode returns the text of the next piece of the file; final marks
+// the last one
+func (d *textDecoder) Decode(data []byte, final bool) (string, error) {
+	data = append(d.pending, data...)
+	d.pending = nil
+	if !d.started {
+		// Wait until a whole byte order mark could be seen
+		if !final && len(data) < 3 {
+			d.pending = data
+			return "", nil
+		}
+		switch d.Encoding {
+		case encUTF8, encUTF8BOM:
+			data = bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF})
+		case encUTF16LE:
+			data = bytes.TrimPrefix(data, []byte{0xFF, 0xFE})
+		case encUTF16BE:
+			data = bytes.TrimPrefix(data, []byte{0xFE, 0xFF})
+		}
+		d.started = true
+	}
+
+	var text string
+	switch d.Encoding {
+	case encUTF8, encUTF8BOM:
+		if !final {
+			cut := len(data) - incompleteUTF8(data)
+			data, d.pending = data[:cut], append([]byte(nil), data[cut:]...)
+		}
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("file is not valid %s", d.Encoding)
+		}
+		text = string(data)
+	case encUTF16LE, encUTF16BE:
+		if !final {
+			cut := len(data) - len(data)%2
+			data, d.pending = data[:cut], append([]byte(nil), data[cut:]...)
+		} else if len(data)%2 != 0 {
+			return "", fmt.Errorf("file is not valid %s", d.Encoding)
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			if d.Encoding == encUTF16LE {
+				units[i] = uint16(data[2*i]) | uint16(data[2*i+1])<<8
+			} else {
+				units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+			}
+		}
+		// Keep a high surrogate until its pair arrives
+		if n := len(units); !final && n > 0 && units[n-1] >= 0xD800 && units[n-1] < 0xDC00 {
+			d.pending = append(data[2*n-2:2*n:2*n], d.pending...)
+			units = units[:n-1]
+		}
+		text = string(utf16.Decode(units))
+	case encCP1252, encLatin1:
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			if d.Encoding == encCP1252 {
+				runes[i] = cp1252Rune(b)
+			} else {
+				runes[i] = rune(b)
+			}
+		}
+		text = string(runes)
+	default:
+		return "", fmt.Errorf("unknown encoding %s", d.Encoding)
+	}
+
+	text = d.carry + text
+	d.carry = ""
+	if !final && strings.HasSuffix(text, "\r") {
+		text, d.carry = text[:len(text)-1], "\r"
+	}
+	crlf := strings.Count(text, "\r\n")
+	d.crlf += crlf
+	d.cr += strings.Count(text, "\r") - crlf
+	d.lf += strings.Count(text, "\n") - crlf
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n"), nil
+}
+
+// Format reports the encoding and the most common line ending so far
+func (d *textDecoder) Format() TextFormat {
+	format := TextFormat{Encoding: d.Encoding, LineEnding: eolLF}
+	switch {
+	case d.crlf > d.lf && d.crlf >= d.cr:
+		format.LineEnding = eolCRLF
+	case d.cr > d.lf && d.cr > d.crlf:
+		format.LineEnding = eolCR
+	}
+	return format
+}
+
+// Number of bytes at the end of data that start a character without
+// finishing it
+func incompleteUTF8(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if utf8.FullRune(data[i:]) {
+				return 0
+			}
+			return len(data) - i
+		}
+	}
+	return 0
+}
+
+// encodeText converts editor text to format. It fails rather than
+// silently losing characters the encoding cannot hold.
+func encodeText(text string, format TextFormat) ([]byte, error) {
+	switch format.LineEnding {
+	case eolCRLF:
+		text = strings.ReplaceAll(text, "\n", "\r\n")
+	case eolCR:
+		text = strings.ReplaceAll(text, "\n", "\r")
+	}
+	switch format.Encoding {
+	case "", encUTF8:
+		return []byte(text), nil
+	case encUTF8BOM:
+		return append([]byte{0xEF, 0xBB, 0xBF}, text...), nil
+	case encUTF16LE, encUTF16BE:
+		units := utf16.Encode([]rune("\uFEFF" + text))
+		out := make([]byte, 0, 2*len(units))
+		for _, u := range units {
+			if format.Encoding == encUTF16LE {
+				out = append(out, byte(u), byte(u>>8))
+			} else {
+				out = append(out, byte(u>>8), byte(u))
+			}
+		}
+		return out, nil
+	case encCP1252, encLatin1:
+		out := make([]byte, 0, len(text))
+		for _, r := range text {
+			c, ok := byte(0), false
+			switch {
+			case r < 0x80 || r >= 0xA0 && r <= 0xFF:
+				c, ok = byte(r), true
+			case format.Encoding == encLatin1:
+				c, ok = byte(r), r <= 0xFF
+			default:
+				for i, h := range cp1252High {
+					if h == r && h != 0 {
+						c, ok = byte(0x80+i), true
+					}
+				}
+			}
+			if !ok {
+				return nil, fmt.Errorf("%q cannot be written in %s", r, format.Encoding)
+			}
+			out = append(out, c)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %s", format.Encoding)
+}
+
+// Windows-1252 code points 0x80-0x9F; the rest of 0xA0-0xFF matches Latin-1
+var cp1252High = [32]rune{
+	'€', 0, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0, 'Ž', 0,
+	0, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0, 'ž', 'Ÿ',
+}
+
+// Encode s as Windows-1252, replacing unmappable characters with '?'
+func encodeCP1252(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r < 0x80 || (r >= 0xA0 && r <= 0xFF):
+			out = append(out, byte(r))
+		default:
+			c := byte('?')
+			for i, h := range cp1252High {
+				if h == r && h != 0 {
+					c = byte(0x80 + i)
+				}
+			}
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Decode one Windows-1252 byte
+func cp1252Rune(b byte) rune {
+	if b >= 0x80 && b < 0xA0 && cp1252High[b-0x80] != 0 {
+		return cp1252High[b-0x80]
+	}
+	return rune(b)
+}
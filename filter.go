@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Saved filters live in the merge database itself
+const savedFiltersTable = "goatpad_filters"
+
+// Operators a condition can use, as shown in the filter builder and
+// written in --where
+var filterOperators = []string{
+	"=", "!=", "<", "<=", ">", ">=",
+	"contains", "does not contain", "starts with", "ends with",
+	"is empty", "is not empty", "within days",
+}
+
+// Operators that take no value
+var unaryOperators = map[string]bool{"is empty": true, "is not empty": true}
+
+// A test on one column of the merge source
+type Condition struct {
+	Join     string // AND or OR with the condition before; unused on the first
+	Column   string
+	Operator string
+	Value    string
+}
+
+type SortKey struct {
+	Column string
+	Desc   bool
+}
+
+// Filter picks and orders the records a merge uses
+type Filter struct {
+	Conditions []Condition
+	Sort       []SortKey
+}
+
+// Where compiles the conditions to an SQL expression with ? parameters,
+// or "" when there are none
+func (f Filter) Where() (string, []interface{}, error) {
+	var b strings.Builder
+	var args []interface{}
+	for i, c := range f.Conditions {
+		if i > 0 {
+			join := strings.ToUpper(c.Join)
+			if join != "OR" {
+				join = "AND"
+			}
+			b.WriteString(" " + join + " ")
+		}
+		col := quoteIdent(c.Column)
+		like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(c.Value)
+		switch c.Operator {
+		case "=", "!=":
+			b.WriteString(col + " " + c.Operator + " ?")
+			args = append(args, c.Value)
+		case "<", "<=", ">", ">=":
+			// Numbers compare as numbers, anything else (like ISO dates) as text
+			if n, err := strconv.ParseFloat(strings.TrimSpace(c.Value), 64); err == nil {
+				b.WriteString("CAST(" + col + " AS REAL) " + c.Operator + " ?")
+				args = append(args, n)
+			} else {
+				b.WriteString(col + " " + c.Operator + " ?")
+				args = append(args, c.Value)
+			}
+		case "contains":
+			b.WriteString(col + ` LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+like+"%")
+		case "does not contain":
+			b.WriteString("IFNULL(" + col + `, '') NOT LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+like+"%")
+		case "starts with":
+			b.WriteString(col + ` LIKE ? ESCAPE '\'`)
+			args = append(args, like+"%")
+		case "ends with":
+			b.WriteString(col + ` LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+like)
+		case "is empty":
+			b.WriteString("IFNULL(" + col + ", '') = ''")
+		case "is not empty":
+			b.WriteString("IFNULL(" + col + ", '') != ''")
+		case "within days":
+			// A date from today up to Value days ahead
+			days, err := strconv.Atoi(strings.TrimSpace(c.Value))
+			if err != nil {
+				return "", nil, fmt.Errorf("within days needs a number of days, not %q", c.Value)
+			}
+			b.WriteString("date(" + col + ") BETWEEN date('now') AND date('now', ?)")
+			args = append(args, fmt.Sprintf("%+d days", days))
+		default:
+			return "", nil, fmt.Errorf("unknown operator %q", c.Operator)
+		}
+	}
+	return b.String(), args, nil
+}
+
+// OrderBy compiles the sort keys, or "" when there are none
+func (f Filter) OrderBy() string {
+	keys := make([]string, len(f.Sort))
+	for i, key := range f.Sort {
+		keys[i] = quoteIdent(key.Column)
+		if key.Desc {
+			keys[i] += " DESC"
+		}
+	}
+	return strings.Join(keys, ", ")
+}
+
+// The SELECT for the records of from, a quoted table name or a
+// subquery (see queryFrom), that pass filter, in its order, with any
+// extra columns after its own (see relationColumns)
+func selectQuery(from string, filter Filter, extra ...string) (string, []interface{}, error) {
+	query := "SELECT * FROM " + from
+	if len(extra) > 0 {
+		query = "SELECT " + relationParent + ".*, " + strings.Join(extra, ", ") + " FROM " + from + " AS " + relationParent
+	}
+	where, args, err := filter.Where()
+	if err != nil {
+		return "", nil, err
+	}
+	if where != "" {
+		query += " WHERE " + where
+	}
+	if order := filter.OrderBy(); order != "" {
+		query += " ORDER BY " + order
+	}
+	return query, args, nil
+}
+
+// A token of --where, remembering whether it was quoted so that a value
+// like 'and' is not read as a keyword
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+// Split --where into words, 'values' and "columns". Runs of =!<> are
+// tokens of their own so Age>=30 needs no spaces.
+func filterTokens(s string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"':
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unclosed %c in %q", r, s)
+				}
+				if runes[i] == r {
+					// A doubled quote stands for itself, as in SQL
+					if i+1 < len(runes) && runes[i+1] == r {
+						b.WriteRune(r)
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, filterToken{b.String(), true})
+		case strings.ContainsRune("=!<>", r):
+			start := i
+			for i < len(runes) && strings.ContainsRune("=!<>", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{string(runes[start:i]), false})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("=!<>'\"", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{string(runes[start:i]), false})
+		}
+	}
+	return tokens, nil
+}
+
+// parseWhere reads conditions written the way the filter builder shows
+// them, such as: Region = 'North' AND Birthday within days 30
+func parseWhere(s string) ([]Condition, error) {
+	tokens, err := filterTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	var conditions []Condition
+	join := ""
+	for i := 0; i < len(tokens); {
+		c := Condition{Join: join, Column: tokens[i].text}
+		i++
+		for _, op := range filterOperators {
+			words := strings.Fields(op)
+			if i+len(words) > len(tokens) {
+				continue
+			}
+			match := true
+			for j, w := range words {
+				if tokens[i+j].quoted || !strings.EqualFold(tokens[i+j].text, w) {
+					match = false
+					break
+				}
+			}
+			// Prefer the longest operator, so "is not empty" beats "is empty"
+			if match && len(strings.Fields(c.Operator)) < len(words) {
+				c.Operator = op
+			}
+		}
+		if c.Operator == "" && i < len(tokens) && tokens[i].text == "<>" {
+			c.Operator = "!="
+		}
+		if c.Operator == "" {
+			return nil, fmt.Errorf("expected an operator after %s", c.Column)
+		}
+		i += len(strings.Fields(c.Operator))
+		if !unaryOperators[c.Operator] {
+			if i >= len(tokens) {
+				return nil, fmt.Errorf("expected a value after %s %s", c.Column, c.Operator)
+			}
+			c.Value = tokens[i].text
+			i++
+		}
+		conditions = append(conditions, c)
+		if i < len(tokens) {
+			join = strings.ToUpper(tokens[i].text)
+			if tokens[i].quoted || (join != "AND" && join != "OR") {
+				return nil, fmt.Errorf("expected AND or OR, not %s", tokens[i].text)
+			}
+			i++
+			if i >= len(tokens) {
+				return nil, fmt.Errorf("expected a condition after %s", join)
+			}
+		}
+	}
+	return conditions, nil
+}
+
+// parseOrderBy reads a list like: Region, Name DESC
+func parseOrderBy(s string) ([]SortKey, error) {
+	var keys []SortKey
+	for _, part := range strings.Split(s, ",") {
+		tokens, err := filterTokens(part)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		key := SortKey{Column: tokens[0].text}
+		if len(tokens) > 2 {
+			return nil, fmt.Errorf("unexpected %s in order by", tokens[2].text)
+		}
+		if len(tokens) == 2 {
+			switch strings.ToUpper(tokens[1].text) {
+			case "ASC":
+			case "DESC":
+				key.Desc = true
+			default:
+				return nil, fmt.Errorf("expected ASC or DESC, not %s", tokens[1].text)
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func createFiltersTable(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + savedFiltersTable + " (name TEXT PRIMARY KEY, source TEXT, filter TEXT)")
+	return err
+}
+
+// Save filter for table under name, replacing any filter of that name
+func saveFilter(db *sql.DB, name, table string, filter Filter) error {
+	if err := createFiltersTable(db); err != nil {
+		return err
+	}
+	data, err := json.Marshal(filter)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO "+savedFiltersTable+" (name, source, filter) VALUES (?, ?, ?)", name, table, string(data))
+	return err
+}
+
+// Load a saved filter and the table it was saved for
+func loadFilter(db *sql.DB, name string) (string, Filter, error) {
+	var filter Filter
+	if err := createFiltersTable(db); err != nil {
+		return "", filter, err
+	}
+	var table, data string
+	err := db.QueryRow("SELECT source, filter FROM "+savedFiltersTable+" WHERE name = ?", name).Scan(&table, &data)
+	if err == sql.ErrNoRows {
+		return "", filter, fmt.Errorf("no saved filter named %q", name)
+	}
+	if err != nil {
+		return "", filter, err
+	}
+	return table, filter, json.Unmarshal([]byte(data), &filter)
+}
+
+// Names of the filters saved for table
+func savedFilters(db *sql.DB, table string) ([]string, error) {
+	if err := createFiltersTable(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT name FROM "+savedFiltersTable+" WHERE source = ? ORDER BY name", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
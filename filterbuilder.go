@@ -0,0 +1,344 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// FilterBuilder edits a Filter in the mail merge dialog: rows of column,
+// operator and value joined by AND or OR, a sort order, and filters
+// saved by name for the current source.
+type FilterBuilder struct {
+	Box        *gtk.Box
+	parent     *gtk.Window
+	db         *sql.DB
+	table      string
+	columns    []string
+	rows       *gtk.Box
+	conditions []*conditionRow
+	sortCombo  *gtk.ComboBoxText
+	descCheck  *gtk.CheckButton
+	savedCombo *gtk.ComboBoxText
+	loading    bool // set while filling in widgets, to hold back changed
+	changed    func()
+}
+
+type conditionRow struct {
+	box    *gtk.Box
+	join   *gtk.ComboBoxText
+	column *gtk.ComboBoxText
+	op     *gtk.ComboBoxText
+	value  *gtk.Entry
+}
+
+// changed is called whenever the filter is edited
+func newFilterBuilder(parent *gtk.Window, db *sql.DB, changed func()) *FilterBuilder {
+	b := &FilterBuilder{parent: parent, db: db, changed: changed}
+	var err error
+	b.Box, err = gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 5)
+	if err != nil {
+		log.Fatal("Unable to create box:", err)
+	}
+
+	// Header: add a condition, or pick and save named filters
+	header, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
+	if err != nil {
+		log.Fatal("Unable to create box:", err)
+	}
+	filterLabel, err := gtk.LabelNew("Filter:")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	addButton, err := gtk.ButtonNewWithLabel("Add Condition")
+	if err != nil {
+		log.Fatal("Unable to create button:", err)
+	}
+	savedLabel, err := gtk.LabelNew("Saved:")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	b.savedCombo, err = gtk.ComboBoxTextNew()
+	if err != nil {
+		log.Fatal("Unable to create combo box:", err)
+	}
+	saveButton, err := gtk.ButtonNewWithLabel("Save...")
+	if err != nil {
+		log.Fatal("Unable to create button:", err)
+	}
+	header.PackStart(filterLabel, false, false, 0)
+	header.PackStart(addButton, false, false, 0)
+	header.PackEnd(saveButton, false, false, 0)
+	header.PackEnd(b.savedCombo, false, false, 0)
+	header.PackEnd(savedLabel, false, false, 0)
+	b.Box.PackStart(header, false, false, 0)
+
+	b.rows, err = gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 5)
+	if err != nil {
+		log.Fatal("Unable to create box:", err)
+	}
+	b.Box.PackStart(b.rows, false, false, 0)
+
+	// Sort order
+	sortBox, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
+	if err != nil {
+		log.Fatal("Unable to create box:", err)
+	}
+	sortLabel, err := gtk.LabelNew("Sort by:")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	b.sortCombo, err = gtk.ComboBoxTextNew()
+	if err != nil {
+		log.Fatal("Unable to create combo box:", err)
+	}
+	b.descCheck, err = gtk.CheckButtonNewWithLabel("Descending")
+	if err != nil {
+		log.Fatal("Unable to create check button:", err)
+	}
+	sortBox.PackStart(sortLabel, false, false, 0)
+	sortBox.PackStart(b.sortCombo, false, false, 0)
+	sortBox.PackStart(b.descCheck, false, false, 0)
+	b.Box.PackStart(sortBox, false, false, 0)
+
+	addButton.Connect("clicked", func() {
+		b.addCondition(Condition{Join: "AND", Operator: "="})
+		b.emit()
+	})
+	b.sortCombo.Connect("changed", b.emit)
+	b.descCheck.Connect("toggled", b.emit)
+	b.savedCombo.Connect("changed", func() {
+		name := b.savedCombo.GetActiveID()
+		if b.loading || name == "" {
+			return
+		}
+		_, filter, err := loadFilter(b.db, name)
+		if err != nil {
+			log.Println("Load filter error:", err)
+			messageDialog(b.parent, "Error", "Unable to load filter: "+err.Error())
+			return
+		}
+		b.SetFilter(filter)
+	})
+	saveButton.Connect("clicked", b.save)
+	return b
+}
+
+// SetSource switches to the columns of table, clearing the filter
+func (b *FilterBuilder) SetSource(table string, columns []string) {
+	b.loading = true
+	defer func() { b.loading = false }()
+	b.table, b.columns = table, columns
+	b.clear()
+	b.sortCombo.RemoveAll()
+	b.sortCombo.Append("", "(none)")
+	for _, col := range columns {
+		b.sortCombo.Append(col, col)
+	}
+	b.sortCombo.SetActiveID("")
+	b.descCheck.SetActive(false)
+	b.refreshSaved()
+}
+
+// Filter as currently built. Rows without a column are skipped.
+func (b *FilterBuilder) Filter() Filter {
+	var filter Filter
+	for _, row := range b.conditions {
+		column := row.column.GetActiveID()
+		if column == "" {
+			continue
+		}
+		value, err := row.value.GetText()
+		if err != nil {
+			log.Println("Get text error:", err)
+		}
+		filter.Conditions = append(filter.Conditions, Condition{
+			Join:     row.join.GetActiveText(),
+			Column:   column,
+			Operator: row.op.GetActiveID(),
+			Value:    value,
+		})
+	}
+	if column := b.sortCombo.GetActiveID(); column != "" {
+		filter.Sort = []SortKey{{Column: column, Desc: b.descCheck.GetActive()}}
+	}
+	return filter
+}
+
+// SetFilter shows filter in the builder. Only the first sort key fits.
+func (b *FilterBuilder) SetFilter(filter Filter) {
+	b.loading = true
+	b.clear()
+	for _, c := range filter.Conditions {
+		b.addCondition(c)
+	}
+	b.sortCombo.SetActiveID("")
+	b.descCheck.SetActive(false)
+	if len(filter.Sort) > 0 {
+		b.sortCombo.SetActiveID(filter.Sort[0].Column)
+		b.descCheck.SetActive(filter.Sort[0].Desc)
+	}
+	b.loading = false
+	b.emit()
+}
+
+func (b *FilterBuilder) emit() {
+	if !b.loading && b.changed != nil {
+		b.changed()
+	}
+}
+
+func (b *FilterBuilder) clear() {
+	for _, row := range b.conditions {
+		row.box.Destroy()
+	}
+	b.conditions = nil
+}
+
+func (b *FilterBuilder) addCondition(c Condition) {
+	row := &conditionRow{}
+	var err error
+	row.box, err = gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
+	if err != nil {
+		log.Fatal("Unable to create box:", err)
+	}
+	row.join, err = gtk.ComboBoxTextNew()
+	if err != nil {
+		log.Fatal("Unable to create combo box:", err)
+	}
+	row.join.Append("AND", "AND")
+	row.join.Append("OR", "OR")
+	if !row.join.SetActiveID(c.Join) {
+		row.join.SetActiveID("AND")
+	}
+	row.join.SetNoShowAll(true) // shown by showJoins
+	row.column, err = gtk.ComboBoxTextNew()
+	if err != nil {
+		log.Fatal("Unable to create combo box:", err)
+	}
+	for _, col := range b.columns {
+		row.column.Append(col, col)
+	}
+	if !row.column.SetActiveID(c.Column) && len(b.columns) > 0 {
+		row.column.SetActive(0)
+	}
+	row.op, err = gtk.ComboBoxTextNew()
+	if err != nil {
+		log.Fatal("Unable to create combo box:", err)
+	}
+	for _, op := range filterOperators {
+		row.op.Append(op, op)
+	}
+	if !row.op.SetActiveID(c.Operator) {
+		row.op.SetActiveID("=")
+	}
+	row.value, err = gtk.EntryNew()
+	if err != nil {
+		log.Fatal("Unable to create entry:", err)
+	}
+	row.value.SetText(c.Value)
+	row.value.SetSensitive(!unaryOperators[row.op.GetActiveID()])
+	removeButton, err := gtk.ButtonNewFromIconName("list-remove", gtk.ICON_SIZE_BUTTON)
+	if err != nil {
+		log.Fatal("Unable to create button:", err)
+	}
+	row.box.PackStart(row.join, false, false, 0)
+	row.box.PackStart(row.column, false, false, 0)
+	row.box.PackStart(row.op, false, false, 0)
+	row.box.PackStart(row.value, true, true, 0)
+	row.box.PackStart(removeButton, false, false, 0)
+
+	row.join.Connect("changed", b.emit)
+	row.column.Connect("changed", b.emit)
+	row.op.Connect("changed", func() {
+		row.value.SetSensitive(!unaryOperators[row.op.GetActiveID()])
+		b.emit()
+	})
+	row.value.Connect("changed", b.emit)
+	removeButton.Connect("clicked", func() {
+		for i, r := range b.conditions {
+			if r == row {
+				b.conditions = append(b.conditions[:i], b.conditions[i+1:]...)
+				break
+			}
+		}
+		row.box.Destroy()
+		b.showJoins()
+		b.emit()
+	})
+
+	b.conditions = append(b.conditions, row)
+	b.rows.PackStart(row.box, false, false, 0)
+	row.box.ShowAll()
+	b.showJoins()
+}
+
+// Only conditions after the first are joined to anything
+func (b *FilterBuilder) showJoins() {
+	for i, row := range b.conditions {
+		row.join.SetVisible(i > 0)
+	}
+}
+
+func (b *FilterBuilder) refreshSaved() {
+	names, err := savedFilters(b.db, b.table)
+	if err != nil {
+		log.Println("Saved filters error:", err)
+	}
+	b.savedCombo.RemoveAll()
+	for _, name := range names {
+		b.savedCombo.Append(name, name)
+	}
+	b.savedCombo.SetSensitive(len(names) > 0)
+}
+
+// Ask for a name and save the filter under it
+func (b *FilterBuilder) save() {
+	dialog, err := gtk.DialogNew()
+	if err != nil {
+		log.Fatal("Unable to create dialog:", err)
+	}
+	dialog.SetTitle("Save Filter")
+	dialog.SetTransientFor(b.parent)
+	dialog.SetModal(true)
+	dialog.AddButton("Save", gtk.RESPONSE_ACCEPT)
+	dialog.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+	dialog.SetDefaultResponse(gtk.RESPONSE_ACCEPT)
+	vbox, err := dialog.GetContentArea()
+	if err != nil {
+		log.Fatal("Unable to get content area:", err)
+	}
+	label, err := gtk.LabelNew("Filter name:")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	entry, err := gtk.EntryNew()
+	if err != nil {
+		log.Fatal("Unable to create entry:", err)
+	}
+	entry.SetActivatesDefault(true)
+	entry.SetText(b.savedCombo.GetActiveID())
+	vbox.PackStart(label, false, false, 5)
+	vbox.PackStart(entry, false, false, 5)
+	vbox.ShowAll()
+
+	if dialog.Run() == gtk.RESPONSE_ACCEPT {
+		name, err := entry.GetText()
+		if err != nil {
+			log.Fatal("Unable to get entry text:", err)
+		}
+		if name == "" {
+			messageDialog(b.parent, "Error", "Filter name cannot be empty")
+		} else if err := saveFilter(b.db, name, b.table, b.Filter()); err != nil {
+			log.Println("Save filter error:", err)
+			messageDialog(b.parent, "Error", "Unable to save filter: "+err.Error())
+		} else {
+			b.loading = true
+			b.refreshSaved()
+			b.savedCombo.SetActiveID(name)
+			b.loading = false
+		}
+	}
+	dialog.Destroy()
+}
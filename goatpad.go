@@ -1,16 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gotk3/gotk3/gdk"
@@ -28,22 +27,172 @@ type Column struct {
 func main() {
 	// CLI flags for batch mode
 	batch := flag.Bool("batch-merge", false, "Run batch mail merge")
-	template := flag.String("template", "", "Template file")
+	template := flag.String("template", "", "Template file: text, RTF, DOCX or "+nativeExt)
 	dbFile := flag.String("db", "", "SQLite database")
+	csvFile := flag.String("csv", "", "Merge the records of this CSV file, with a header row, instead of a --db table")
+	jsonFile := flag.String("json", "", "Merge the records of this JSON array or JSON Lines file instead of a --db table")
 	output := flag.String("output", "", "Output folder")
+	table := flag.String("table", "contacts", "Table or view to merge")
+	query := flag.String("query", "", "Merge the results of this read-only SELECT instead of --table, e.g. \"SELECT c.*, SUM(o.Total) AS Spent FROM contacts c JOIN orders o ON o.contact_id = c.id GROUP BY c.id\"")
+	where := flag.String("where", "", "Only merge records matching conditions, e.g. \"Region = 'North' AND Age >= 30\"")
+	orderBy := flag.String("order-by", "", "Merge records in this order, e.g. \"Region, Name DESC\"")
+	filterName := flag.String("filter", "", "Use a filter saved from the merge dialog")
+	manifest := flag.String("manifest", "", "Write per-record results here, as JSON if it ends in .json (default manifest.csv in the output folder)")
+	dryRun := flag.Bool("dry-run", false, "Check the merge without writing or sending anything: unknown and unused fields, blank required fields, clashing file names and invalid dates")
+	combined := flag.Bool("combined", false, "Merge every record into one file, merged.<ext>, a page each")
+	emailTo := flag.String("email-to", "", "Write email messages to this address template, e.g. \"{{.Email}}\", instead of documents")
+	emailFrom := flag.String("email-from", "", "Sender address for --email-to")
+	emailCc := flag.String("email-cc", "", "Cc address template for --email-to")
+	emailSubject := flag.String("email-subject", "", "Subject template for --email-to, e.g. \"Hello {{.Name}}\"")
+	emailAttach := flag.String("email-attach", "", "Files to attach for --email-to, separated by ; (templates allowed)")
+	smtpServer := flag.String("smtp", "", "Send --email-to messages through this SMTP server, host:port, instead of writing them (password from $GOATPAD_SMTP_PASSWORD)")
+	smtpSecurity := flag.String("smtp-security", securitySTARTTLS, "SMTP connection security: starttls, tls or none")
+	smtpUser := flag.String("smtp-user", "", "SMTP user name, if the server needs one")
+	smtpAuth := flag.String("smtp-auth", "plain", "SMTP authentication: plain or login")
+	smtpRate := flag.Float64("smtp-rate", 30, "Send at most this many messages a minute (0 for no limit)")
+	smtpRetries := flag.Int("smtp-retries", 3, "Retry a message this many times after a temporary failure")
+	smtpTestTo := flag.String("smtp-test-to", "", "Dry run: send every message to this address instead")
+	labels := flag.String("labels", "", "Print one PDF of labels, a record each, on an Avery sheet such as 5160 or L7163, or a custom grid such as \"a4 3x8 top=10mm left=5mm hpitch=66mm\"")
+	envelope := flag.String("envelope", "", "Print one PDF of envelopes, a record each: #10, #9, Monarch, DL, C5, C6 or a size such as 9.5inx4.125in")
+	returnAddress := flag.String("return-address", "", "Return address for --envelope, lines separated by |")
+	var relationFlag relationFlags
+	flag.Var(&relationFlag, "relation", "Child rows for each record, e.g. \"Items: invoice_lines.invoice_id = id order by line_no\" (repeatable; adds to relations saved in the merge dialog)")
+	namePattern := flag.String("name-pattern", "", "Output file name template, e.g. \"{{.LastName}}_{{.ID}}.txt\" (default resume_{{.Name | lower}}.txt)")
 	flag.Parse()
 
 	if *batch {
-		if *template == "" || *dbFile == "" || *output == "" {
-			log.Fatal("Missing required flags: --template, --db, --output")
+		if *template == "" || (*dbFile == "" && *csvFile == "" && *jsonFile == "") || (*output == "" && !*dryRun) {
+			log.Fatal("Missing required flags: --template, --db, --csv or --json, --output")
 		}
-		db, err := sql.Open("sqlite", *dbFile)
+		if *csvFile != "" && *jsonFile != "" {
+			log.Fatal("Use either --csv or --json, not both")
+		}
+		dataFile := *csvFile
+		if *jsonFile != "" {
+			dataFile = *jsonFile
+		}
+		if *where != "" && *filterName != "" {
+			log.Fatal("Use either --where or --filter, not both")
+		}
+		if *dbFile == "" && (*filterName != "" || *smtpServer != "") {
+			log.Fatal("--filter and --smtp need --db, for saved filters and the delivery log")
+		}
+		if dataFile != "" && len(relationFlag) > 0 {
+			log.Fatal("--relation needs a --db table, not --csv or --json")
+		}
+		if *query != "" && (dataFile != "" || *dbFile == "") {
+			log.Fatal("--query needs --db, not --csv or --json")
+		}
+		if *query != "" && len(relationFlag) > 0 {
+			log.Fatal("Use either --query or --relation, not both; a query can join child rows itself")
+		}
+		// Only needed for tables, saved filters and sending with a data file
+		var db *sql.DB
+		var err error
+		if *dbFile != "" {
+			if db, err = sql.Open("sqlite", *dbFile); err != nil {
+				log.Fatal("Failed to open database:", err)
+			}
+		}
+		job := MergeJob{Table: *table, DataFile: dataFile, Query: *query, Template: *template, Output: *output, NamePattern: *namePattern, Manifest: *manifest, Combined: *combined}
+		if *emailTo != "" {
+			job.Email = &EmailOptions{From: *emailFrom, To: *emailTo, Cc: *emailCc, Subject: *emailSubject, Attachments: *emailAttach}
+		}
+		if *labels != "" {
+			layout, err := parseLabelLayout(*labels)
+			if err != nil {
+				log.Fatal("Invalid --labels:", err)
+			}
+			job.Labels = &layout
+		}
+		if *envelope != "" {
+			size, err := parseEnvelopeSize(*envelope)
+			if err != nil {
+				log.Fatal("Invalid --envelope:", err)
+			}
+			job.Envelope = &size
+			job.ReturnAddress = strings.ReplaceAll(*returnAddress, "|", "\n")
+		}
+		if *smtpServer != "" {
+			job.SMTP = &SMTPOptions{
+				Server:      *smtpServer,
+				Security:    *smtpSecurity,
+				Username:    *smtpUser,
+				Password:    os.Getenv("GOATPAD_SMTP_PASSWORD"),
+				Auth:        *smtpAuth,
+				Rate:        *smtpRate,
+				Retries:     *smtpRetries,
+				TestAddress: *smtpTestTo,
+			}
+		}
+		if *filterName != "" {
+			source, filter, err := loadFilter(db, *filterName)
+			if err != nil {
+				log.Fatal("Unable to load filter:", err)
+			}
+			job.Filter = filter
+			// The filter's own table unless --table says otherwise
+			tableSet := false
+			flag.Visit(func(f *flag.Flag) {
+				tableSet = tableSet || f.Name == "table"
+			})
+			if !tableSet {
+				job.Table = source
+			}
+		}
+		if *where != "" {
+			if job.Filter.Conditions, err = parseWhere(*where); err != nil {
+				log.Fatal("Invalid --where:", err)
+			}
+		}
+		if *orderBy != "" {
+			if job.Filter.Sort, err = parseOrderBy(*orderBy); err != nil {
+				log.Fatal("Invalid --order-by:", err)
+			}
+		}
+		if dataFile == "" && job.Query == "" {
+			saved, err := savedRelations(db, job.Table)
+			if err != nil {
+				log.Fatal("Unable to load relations:", err)
+			}
+			job.Relations = withRelations(saved, relationFlag)
+		}
+		if *dryRun {
+			report, err := dryRunMerge(context.Background(), db, job)
+			if db != nil {
+				db.Close()
+			}
+			if err != nil {
+				log.Fatal("Dry run failed:", err)
+			}
+			for _, issue := range report.Issues {
+				fmt.Printf("Record %d (%s) %s: %s\n", issue.Record, issue.Key, issue.Kind, issue.Message)
+			}
+			for _, line := range report.Fields() {
+				fmt.Println(line)
+			}
+			fmt.Println(report.Summary())
+			os.Exit(report.ExitCode())
+		}
+		report, err := mailMerge(context.Background(), db, job, nil)
+		if db != nil {
+			db.Close()
+		}
+		if report == nil {
+			log.Fatal("Mail merge failed:", err)
+		}
+		for _, result := range report.Results {
+			if result.Status != statusOK && result.Status != statusSkipped {
+				log.Printf("Record %d (%s) failed: %s", result.Record, result.Key, result.Error)
+			}
+		}
+		fmt.Println(report.Summary())
 		if err != nil {
-			log.Fatal("Failed to open database:", err)
+			log.Println("Manifest error:", err)
+			os.Exit(exitFailed)
 		}
-		defer db.Close()
-		mailMerge(db, *template, *output)
-		return
+		fmt.Println("Manifest:", report.Manifest)
+		os.Exit(report.ExitCode())
 	}
 
 	// Initialize SQLite database for GUI
@@ -97,6 +246,22 @@ func main() {
 	centerTag.SetProperty("justification", gtk.JUSTIFY_CENTER)
 	tagTable.Add(centerTag)
 
+	// Comment side panel
+	commentsBoxObj, err := builder.GetObject("comments_box")
+	if err != nil {
+		log.Fatal("Failed to get comments panel:", err)
+	}
+	ed := newEditor(window, textView, buffer, commentsBoxObj.(*gtk.Box))
+
+	ed.fields = newMergeFields(ed, db)
+
+	// Status bar
+	statusBarObj, err := builder.GetObject("status_bar")
+	if err != nil {
+		log.Fatal("Failed to get status bar:", err)
+	}
+	setupStatusBar(ed, statusBarObj.(*gtk.Statusbar))
+
 	// Bold button
 	boldBtnObj, _ := builder.GetObject("bold_button")
 	boldBtn := boldBtnObj.(*gtk.ToolButton)
@@ -162,25 +327,67 @@ func main() {
 			log.Fatal("Unable to create file chooser dialog:", err)
 		}
 		filter, _ := gtk.FileFilterNew()
+		filter.AddPattern("*" + nativeExt)
 		filter.AddPattern("*.txt")
 		filter.AddPattern("*.rtf")
+		filter.AddPattern("*.docx")
+		filter.AddPattern("*.odt")
+		filter.AddPattern("*.html")
+		filter.AddPattern("*.pdf")
 		dialog.AddFilter(filter)
+		// Plain text is written back the way it was read unless changed here
+		dialog.AddChoice("encoding", "Encoding:", encodings, encodings)
+		dialog.AddChoice("line-ending", "Line endings:", lineEndings, []string{"LF (Unix)", "CRLF (Windows)", "CR (classic Mac)"})
+		dialog.SetChoice("encoding", ed.format.Encoding)
+		dialog.SetChoice("line-ending", ed.format.LineEnding)
 		if dialog.Run() == gtk.RESPONSE_ACCEPT {
 			filename := dialog.GetFilename()
-			start, end := buffer.GetBounds()
-			text, _ := buffer.GetText(start, end, false)
+			doc := ed.Document()
+			text := doc.FinalText()
+			ed.format = TextFormat{dialog.GetChoice("encoding"), dialog.GetChoice("line-ending")}
+			format := ed.format
 			go func() {
-				if strings.HasSuffix(filename, ".rtf") {
-					rtf := "{\\rtf1\\ansi\\deff0\\fonttbl{\\f0 Arial;}\\fs24 " + text + "}"
-					os.WriteFile(filename, []byte(rtf), 0644)
+				if strings.HasSuffix(filename, nativeExt) {
+					if err := saveDocument(filename, doc); err != nil {
+						log.Println("Save error:", err)
+					}
+				} else if strings.HasSuffix(filename, ".docx") {
+					if err := saveDOCX(filename, doc); err != nil {
+						log.Println("Save error:", err)
+					}
+				} else if strings.HasSuffix(filename, ".odt") {
+					if err := saveODT(filename, doc); err != nil {
+						log.Println("Save error:", err)
+					}
+				} else if strings.HasSuffix(filename, ".html") {
+					if err := saveHTML(filename, doc); err != nil {
+						log.Println("Save error:", err)
+					}
+				} else if strings.HasSuffix(filename, ".pdf") {
+					if err := savePDF(filename, doc); err != nil {
+						log.Println("Save error:", err)
+					}
+				} else if strings.HasSuffix(filename, ".rtf") {
+					if err := saveRTF(filename, doc); err != nil {
+						log.Println("Save error:", err)
+					}
 				} else {
+					data, err := encodeText(text, format)
+					if err != nil {
+						log.Println("Save error:", err)
+						glib.IdleAdd(func() bool {
+							messageDialog(window, "Error", "Unable to save: "+err.Error())
+							return false
+						})
+						return
+					}
 					file, err := os.Create(filename)
 					if err != nil {
 						log.Println("Save error:", err)
 						return
 					}
 					defer file.Close()
-					_, err = io.WriteString(file, text)
+					_, err = file.Write(data)
 					if err != nil {
 						log.Println("Write error:", err)
 					}
@@ -203,37 +410,44 @@ func main() {
 			log.Fatal("Unable to create file chooser dialog:", err)
 		}
 		filter, _ := gtk.FileFilterNew()
+		filter.AddPattern("*" + nativeExt)
 		filter.AddPattern("*.txt")
 		filter.AddPattern("*.rtf")
 		dialog.AddFilter(filter)
-		if dialog.Run() == gtk.RESPONSE_ACCEPT {
-			filename := dialog.GetFilename()
-			go func() {
-				file, err := os.Open(filename)
-				if err != nil {
-					log.Println("Open error:", err)
-					return
-				}
-				defer file.Close()
-				data, err := io.ReadAll(file)
-				if err != nil {
-					log.Println("Read error:", err)
-					return
-				}
-				glib.IdleAdd(func() bool {
-					buffer.SetText(string(data))
-					return false
-				})
-			}()
-		}
+		dialog.AddChoice("encoding", "Encoding:", append([]string{"auto"}, encodings...), append([]string{"Auto-detect"}, encodings...))
+		dialog.SetChoice("encoding", "auto")
+		response := dialog.Run()
+		filename := dialog.GetFilename()
+		encoding := dialog.GetChoice("encoding")
 		dialog.Destroy()
+		if response != gtk.RESPONSE_ACCEPT {
+			return
+		}
+		if !strings.HasSuffix(filename, nativeExt) {
+			if encoding == "auto" {
+				encoding = ""
+			}
+			openTextFile(window, ed, filename, encoding)
+			return
+		}
+		go func() {
+			doc, err := loadDocument(filename)
+			if err != nil {
+				log.Println("Open error:", err)
+				return
+			}
+			glib.IdleAdd(func() bool {
+				ed.LoadDocument(doc)
+				return false
+			})
+		}()
 	})
 
 	// Mail merge button
 	mailMergeBtnObj, _ := builder.GetObject("mail_merge_button")
 	mailMergeBtn := mailMergeBtnObj.(*gtk.ToolButton)
 	mailMergeBtn.Connect("clicked", func() {
-		mailMergeDialog(window, db)
+		mailMergeDialog(window, db, ed.fields)
 	})
 
 	// Manage data button
@@ -243,6 +457,72 @@ func main() {
 		createTableDialog(window, db)
 	})
 
+	// Track changes toggle
+	trackBtnObj, _ := builder.GetObject("track_changes_button")
+	trackBtn := trackBtnObj.(*gtk.ToggleToolButton)
+	trackBtn.Connect("toggled", func() {
+		ed.tracker.Enabled = trackBtn.GetActive()
+	})
+
+	// Review button
+	reviewBtnObj, _ := builder.GetObject("review_button")
+	reviewBtn := reviewBtnObj.(*gtk.ToolButton)
+	reviewBtn.Connect("clicked", func() {
+		reviewDialog(window, ed)
+	})
+
+	// Comment button
+	commentBtnObj, _ := builder.GetObject("comment_button")
+	commentBtn := commentBtnObj.(*gtk.ToolButton)
+	commentBtn.Connect("clicked", func() {
+		start, end, ok := buffer.GetSelectionBounds()
+		if !ok {
+			messageDialog(window, "Error", "Select the text to comment on")
+			return
+		}
+		from, to := start.GetOffset(), end.GetOffset()
+		if text, ok := textInputDialog(window, "Add Comment", "Comment:"); ok {
+			ed.comments.Add(from, to, text)
+		}
+	})
+
+	// Properties button
+	propertiesBtnObj, _ := builder.GetObject("properties_button")
+	propertiesBtn := propertiesBtnObj.(*gtk.ToolButton)
+	propertiesBtn.Connect("clicked", func() {
+		propertiesDialog(window, ed)
+	})
+
+	// Hyperlink button
+	linkBtnObj, _ := builder.GetObject("link_button")
+	linkBtn := linkBtnObj.(*gtk.ToolButton)
+	linkBtn.Connect("clicked", func() {
+		hyperlinkDialog(window, ed)
+	})
+
+	// Insert merge field button
+	mergeFieldBtnObj, _ := builder.GetObject("merge_field_button")
+	mergeFieldBtn := mergeFieldBtnObj.(*gtk.ToolButton)
+	mergeFieldBtn.Connect("clicked", func() {
+		menu := ed.fields.Menu()
+		menu.PopupAtWidget(mergeFieldBtn, gdk.GDK_GRAVITY_SOUTH_WEST, gdk.GDK_GRAVITY_NORTH_WEST, nil)
+	})
+
+	// Merge preview toggle
+	preview := newMergePreview(builder, ed, db)
+	previewBtnObj, _ := builder.GetObject("preview_button")
+	previewBtn := previewBtnObj.(*gtk.ToggleToolButton)
+	previewBtn.Connect("toggled", func() {
+		if previewBtn.GetActive() {
+			if !preview.Start() {
+				// Nothing to preview; toggles back through Stop
+				previewBtn.SetActive(false)
+			}
+		} else {
+			preview.Stop()
+		}
+	})
+
 	// Window close
 	window.Connect("destroy", gtk.MainQuit)
 	window.ShowAll()
@@ -598,92 +878,9 @@ func updateRow(db *sql.DB, tableName string, columns []Column, store *gtk.ListSt
 	}
 }
 
-// Mail merge function
-func mailMerge(db *sql.DB, templateFile, outputFolder string) {
-	// Read template async
-	templateData, err := os.ReadFile(templateFile)
-	if err != nil {
-		log.Println("Template read error:", err)
-		return
-	}
-	template := string(templateData)
-
-	// Get columns
-	rows, err := db.Query("PRAGMA table_info(contacts)")
-	if err != nil {
-		log.Println("Table info error:", err)
-		return
-	}
-	var columns []string
-	for rows.Next() {
-		var cid int
-		var name, colType string
-		var notnull, pk int
-		var dflt_value *string
-		err = rows.Scan(&cid, &name, &colType, &notnull, &dflt_value, &pk)
-		if err != nil {
-			log.Println("Scan error:", err)
-			continue
-		}
-		columns = append(columns, name)
-	}
-	rows.Close()
-
-	// Query data
-	query := fmt.Sprintf("SELECT %s FROM contacts", strings.Join(columns, ", "))
-	rows, err = db.Query(query)
-	if err != nil {
-		log.Println("Query error:", err)
-		return
-	}
-	defer rows.Close()
-
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 50) // Limit goroutines for Win98
-	for rows.Next() {
-		vals := make([]interface{}, len(columns))
-		for i := range vals {
-			vals[i] = new(string)
-		}
-		err = rows.Scan(vals...)
-		if err != nil {
-			log.Println("Scan error:", err)
-			continue
-		}
-		wg.Add(1)
-		semaphore <- struct{}{} // Acquire
-		go func(vals []interface{}) {
-			defer wg.Done()
-			defer func() { <-semaphore }() // Release
-			content := template
-			name := ""
-			for i, val := range vals {
-				str := *(val.(*string))
-				content = strings.ReplaceAll(content, "{{"+columns[i]+"}}", str)
-				if columns[i] == "Name" {
-					name = str
-				}
-			}
-			safeName := strings.ReplaceAll(strings.ToLower(name), " ", "_")
-			outputFile := filepath.Join(outputFolder, "resume_"+safeName+".txt")
-			file, err := os.Create(outputFile)
-			if err != nil {
-				log.Println("Create error:", err)
-				return
-			}
-			defer file.Close()
-			_, err = io.WriteString(file, content)
-			if err != nil {
-				log.Println("Write error:", err)
-			}
-		}(vals)
-	}
-	wg.Wait()
-	log.Println("Mail merge complete")
-}
-
-// Mail merge dialog
-func mailMergeDialog(parent *gtk.Window, db *sql.DB) {
+// Mail merge dialog. The data source starts as the merge fields' table
+// and picking another one switches the fields over too.
+func mailMergeDialog(parent *gtk.Window, db *sql.DB, fields *MergeFields) {
 	dialog, err := gtk.DialogNew()
 	if err != nil {
 		log.Fatal("Unable to create dialog:", err)
@@ -691,6 +888,7 @@ func mailMergeDialog(parent *gtk.Window, db *sql.DB) {
 	dialog.SetTitle("Mail Merge")
 	dialog.SetTransientFor(parent)
 	dialog.SetModal(true)
+	dialog.AddButton("Validate", gtk.RESPONSE_APPLY)
 	dialog.AddButton("Run Merge", gtk.RESPONSE_ACCEPT)
 	dialog.AddButton("Cancel", gtk.RESPONSE_CANCEL)
 
@@ -752,6 +950,224 @@ func mailMergeDialog(parent *gtk.Window, db *sql.DB) {
 	grid.Attach(outputEntry, 1, 1, 1, 1)
 	grid.Attach(outputButton, 2, 1, 1, 1)
 
+	// Data source
+	sourceLabel, err := gtk.LabelNew("Data Source:")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	sourceCombo, err := gtk.ComboBoxTextNew()
+	if err != nil {
+		log.Fatal("Unable to create combo box:", err)
+	}
+	sources, err := dataSources(db)
+	if err != nil {
+		log.Println("Table list error:", err)
+	}
+	for _, source := range sources {
+		sourceCombo.Append(source.Name, source.Label())
+	}
+	sourceCombo.Append(customQueryID, "Custom query")
+	fileButton, err := gtk.ButtonNewWithLabel("File...")
+	if err != nil {
+		log.Fatal("Unable to create button:", err)
+	}
+	grid.Attach(sourceLabel, 0, 2, 1, 1)
+	grid.Attach(sourceCombo, 1, 2, 1, 1)
+	grid.Attach(fileButton, 2, 2, 1, 1)
+	// A CSV or JSON file picked as the source is loaded into a database of
+	// its own
+	var dataFile, fileTable string
+	var fileDB *sql.DB
+	defer func() {
+		if fileDB != nil {
+			fileDB.Close()
+		}
+	}()
+	// The database and table the chosen source reads from
+	source := func() (*sql.DB, string) {
+		switch sourceCombo.GetActiveID() {
+		case fileSourceID:
+			return fileDB, fileTable
+		case customQueryID:
+			return db, customQueryName
+		}
+		return db, sourceCombo.GetActiveID()
+	}
+
+	// Output file names
+	nameLabel, err := gtk.LabelNew("File Names:")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	nameEntry, err := gtk.EntryNew()
+	if err != nil {
+		log.Fatal("Unable to create entry:", err)
+	}
+	nameEntry.SetPlaceholderText(namedPattern)
+	nameEntry.SetTooltipText("A template such as {{.LastName}}_{{.ID}}. Unsafe characters become _ and repeated names get _2, _3...")
+	extCombo, err := gtk.ComboBoxTextNewWithEntry()
+	if err != nil {
+		log.Fatal("Unable to create combo box:", err)
+	}
+	for _, ext := range []string{".txt", ".md", ".html", ".csv", ".rtf", ".pdf", ".docx", ".odt"} {
+		extCombo.AppendText(ext)
+	}
+	extCombo.SetActive(0)
+	nameExample, err := gtk.LabelNew("")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	nameExample.SetXAlign(0)
+	grid.Attach(nameLabel, 0, 3, 1, 1)
+	grid.Attach(nameEntry, 1, 3, 1, 1)
+	grid.Attach(extCombo, 2, 3, 1, 1)
+	grid.Attach(nameExample, 1, 4, 2, 1)
+	combinedCheck, err := gtk.CheckButtonNewWithLabel("Combine into one document, a page per record")
+	if err != nil {
+		log.Fatal("Unable to create check button:", err)
+	}
+	grid.Attach(combinedCheck, 1, 5, 2, 1)
+
+	// Labels and envelopes
+	printLabel, err := gtk.LabelNew("Print:")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	printCombo, err := gtk.ComboBoxTextNew()
+	if err != nil {
+		log.Fatal("Unable to create combo box:", err)
+	}
+	printCombo.Append("", "Documents")
+	printCombo.Append("labels", "Labels")
+	printCombo.Append("envelopes", "Envelopes")
+	printCombo.SetActiveID("")
+	sizeCombo, err := gtk.ComboBoxTextNewWithEntry()
+	if err != nil {
+		log.Fatal("Unable to create combo box:", err)
+	}
+	sizeCombo.SetTooltipText("A preset, or for labels a custom grid such as \"letter 3x10 top=0.5in left=0.2in hpitch=2.75in\"")
+	returnLabel, err := gtk.LabelNew("Return Address:")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	returnEntry, err := gtk.EntryNew()
+	if err != nil {
+		log.Fatal("Unable to create entry:", err)
+	}
+	returnEntry.SetPlaceholderText("Lines separated by |")
+	grid.Attach(printLabel, 0, 6, 1, 1)
+	grid.Attach(printCombo, 1, 6, 1, 1)
+	grid.Attach(sizeCombo, 2, 6, 1, 1)
+	grid.Attach(returnLabel, 0, 7, 1, 1)
+	grid.Attach(returnEntry, 1, 7, 2, 1)
+	// Offer the sizes for what is being printed
+	updatePrint := func() {
+		mode := printCombo.GetActiveID()
+		sizeCombo.RemoveAll()
+		switch mode {
+		case "labels":
+			for _, preset := range labelPresets {
+				sizeCombo.AppendText(preset.Name)
+			}
+		case "envelopes":
+			for _, preset := range envelopePresets {
+				sizeCombo.AppendText(preset.Name)
+			}
+		}
+		sizeCombo.SetActive(0)
+		sizeCombo.SetSensitive(mode != "")
+		returnEntry.SetSensitive(mode == "envelopes")
+		combinedCheck.SetSensitive(mode == "")
+		extCombo.SetSensitive(mode == "")
+	}
+	updatePrint()
+
+	// Custom query, under the data source while it is chosen. Run lists
+	// its columns and previews its results.
+	queryLabel, err := gtk.LabelNew("Query:")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	queryView, err := gtk.TextViewNew()
+	if err != nil {
+		log.Fatal("Unable to create text view:", err)
+	}
+	queryView.SetMonospace(true)
+	queryView.SetWrapMode(gtk.WRAP_WORD_CHAR)
+	queryView.SetTooltipText("A read-only SELECT, e.g. SELECT c.*, COUNT(o.id) AS Orders FROM contacts c LEFT JOIN orders o ON o.contact_id = c.id GROUP BY c.id")
+	queryScrolled, err := gtk.ScrolledWindowNew(nil, nil)
+	if err != nil {
+		log.Fatal("Unable to create scrolled window:", err)
+	}
+	queryScrolled.SetPolicy(gtk.POLICY_AUTOMATIC, gtk.POLICY_AUTOMATIC)
+	queryScrolled.SetMinContentHeight(60)
+	queryScrolled.Add(queryView)
+	queryButton, err := gtk.ButtonNewWithLabel("Run")
+	if err != nil {
+		log.Fatal("Unable to create button:", err)
+	}
+	queryButton.SetVAlign(gtk.ALIGN_START)
+	grid.InsertNextTo(sourceCombo, gtk.POS_BOTTOM)
+	grid.AttachNextTo(queryLabel, sourceLabel, gtk.POS_BOTTOM, 1, 1)
+	grid.AttachNextTo(queryScrolled, sourceCombo, gtk.POS_BOTTOM, 1, 1)
+	grid.AttachNextTo(queryButton, fileButton, gtk.POS_BOTTOM, 1, 1)
+	queryLabel.SetNoShowAll(true)
+	queryScrolled.SetNoShowAll(true)
+	queryButton.SetNoShowAll(true)
+	showQuery := func(show bool) {
+		if show {
+			queryLabel.Show()
+			queryScrolled.ShowAll()
+			queryButton.Show()
+		} else {
+			queryLabel.Hide()
+			queryScrolled.Hide()
+			queryButton.Hide()
+		}
+	}
+	queryText := func() string {
+		buffer, err := queryView.GetBuffer()
+		if err != nil {
+			log.Fatal("Unable to get buffer:", err)
+		}
+		start, end := buffer.GetBounds()
+		text, err := buffer.GetText(start, end, false)
+		if err != nil {
+			log.Println("Get text error:", err)
+		}
+		return strings.TrimSpace(text)
+	}
+	// The query last run, which the preview shows
+	var query string
+	if fields.Query != "" {
+		query = fields.Query
+		buffer, err := queryView.GetBuffer()
+		if err != nil {
+			log.Fatal("Unable to get buffer:", err)
+		}
+		buffer.SetText(query)
+	}
+
+	// Email output
+	var updateNameExample func()
+	emailForm := newEmailForm(func() {
+		updateNameExample()
+	})
+	box.PackStart(emailForm.Expander, false, false, 5)
+
+	// Filter and sort, applied to the data preview as they are edited
+	var refreshPreview func()
+	filter := newFilterBuilder(parent, db, func() {
+		refreshPreview()
+	})
+	box.PackStart(filter.Box, false, false, 5)
+
+	// Child rows from related tables
+	relations := newRelationEditor(parent, db, func() {
+		refreshPreview()
+	})
+	box.PackStart(relations.Expander, false, false, 5)
+
 	// Data preview
 	previewLabel, err := gtk.LabelNew("Data Preview:")
 	if err != nil {
@@ -776,64 +1192,156 @@ func mailMergeDialog(parent *gtk.Window, db *sql.DB) {
 	scrolled.SetMinContentHeight(100)
 	box.PackStart(scrolled, true, true, 5)
 
-	// Load columns and data
-	rows, err := db.Query("PRAGMA table_info(contacts)")
-	if err == nil {
-		var columns []string
-		for rows.Next() {
-			var cid int
-			var name, colType string
-			var notnull, pk int
-			var dflt_value *string
-			err = rows.Scan(&cid, &name, &colType, &notnull, &dflt_value, &pk)
-			if err != nil {
-				log.Println("Scan error:", err)
-				continue
-			}
-			columns = append(columns, name)
-			renderer, err := gtk.CellRendererTextNew()
-			if err != nil {
-				log.Fatal("Unable to create cell renderer:", err)
-			}
-			column, err := gtk.TreeViewColumnNew()
+	// Show the file name the first record would get
+	var previewColumns []string
+	var previewRecords [][]string
+	updateNameExample = func() {
+		pattern, _ := nameEntry.GetText()
+		ext := extCombo.GetActiveText()
+		if emailForm.Options() != nil {
+			ext = emailExtension
+		}
+		namer, err := newOutputNamer(pattern, ext, previewColumns)
+		if err != nil {
+			nameExample.SetText(err.Error())
+		} else if mode := printCombo.GetActiveID(); mode != "" {
+			nameExample.SetText("e.g. " + mode + ".pdf")
+		} else if combinedCheck.GetActive() && emailForm.Options() != nil {
+			nameExample.SetText("e.g. " + combinedName + mboxExtension)
+		} else if combinedCheck.GetActive() {
+			nameExample.SetText("e.g. " + combinedName + namer.Ext())
+		} else if len(previewRecords) > 0 {
+			name, err := namer.Name(previewColumns, previewRecords[0])
 			if err != nil {
-				log.Fatal("Unable to create tree view column:", err)
+				nameExample.SetText(err.Error())
+			} else {
+				nameExample.SetText("e.g. " + name)
 			}
-			column.SetTitle(name)
-			column.PackStart(renderer, true)
-			column.AddAttribute(renderer, "text", len(columns)-1)
-			treeView.AppendColumn(column)
+		} else {
+			nameExample.SetText("")
 		}
-		rows.Close()
-		types := make([]glib.Type, len(columns))
-		for i := range types {
-			types[i] = glib.TYPE_STRING
+	}
+	nameEntry.Connect("changed", updateNameExample)
+	extCombo.Connect("changed", updateNameExample)
+	combinedCheck.Connect("toggled", updateNameExample)
+	printCombo.Connect("changed", func() {
+		updatePrint()
+		updateNameExample()
+	})
+
+	// Load columns and data for the chosen source
+	refreshPreview = func() {
+		data, table := source()
+		var columns []string
+		var records [][]string
+		var err error
+		if sourceCombo.GetActiveID() == customQueryID {
+			columns, records, err = loadQueryRecords(data, query, filter.Filter())
+		} else {
+			columns, records, err = loadRecords(data, table, filter.Filter(), relations.Relations())
 		}
-		store, err = gtk.ListStoreNew(types...)
 		if err != nil {
-			log.Fatal("Unable to create list store:", err)
+			log.Println("Query error:", err)
+			previewLabel.SetText("Data Preview: " + err.Error())
+		} else {
+			previewLabel.SetText(fmt.Sprintf("Data Preview: %d records", len(records)))
 		}
-		treeView.SetModel(store)
-		rows, err = db.Query("SELECT * FROM contacts")
-		if err == nil {
-			for rows.Next() {
-				vals := make([]interface{}, len(columns))
-				for i := range vals {
-					vals[i] = new(string)
+		fillDataPreview(treeView, columns, records)
+		previewColumns, previewRecords = columns, records
+		updateNameExample()
+	}
+	sourceCombo.Connect("changed", func() {
+		data, table := source()
+		id := sourceCombo.GetActiveID()
+		showQuery(id == customQueryID)
+		if id == customQueryID {
+			// Columns only once the query has run
+			var names []string
+			if query != "" {
+				var err error
+				if names, err = queryColumns(data, query); err != nil {
+					log.Println("Query error:", err)
 				}
-				err = rows.Scan(vals...)
-				if err != nil {
-					log.Println("Scan error:", err)
-					continue
+			}
+			filter.SetSource(table, names)
+			relations.SetSource("", nil)
+			refreshPreview()
+			return
+		}
+		columns, err := tableColumns(data, table)
+		if err != nil {
+			log.Println("Table info error:", err)
+		}
+		filter.SetSource(table, colNames(columns))
+		if id == fileSourceID {
+			relations.SetSource("", nil)
+		} else {
+			relations.SetSource(table, colNames(columns))
+		}
+		refreshPreview()
+	})
+	queryButton.Connect("clicked", func() {
+		text := queryText()
+		names, err := queryColumns(db, text)
+		if err != nil {
+			messageDialog(parent, "Error", "Invalid "+err.Error())
+			return
+		}
+		query = text
+		filter.SetSource(customQueryName, names)
+		refreshPreview()
+	})
+	sourceID := fields.Table
+	if fields.Query != "" {
+		sourceID = customQueryID
+	}
+	if !sourceCombo.SetActiveID(sourceID) && len(sources) > 0 {
+		sourceCombo.SetActive(0)
+	}
+
+	// Data file button
+	fileButton.Connect("clicked", func() {
+		fileDialog, err := gtk.FileChooserDialogNewWith2Buttons(
+			"Select Data File", parent, gtk.FILE_CHOOSER_ACTION_OPEN,
+			"Cancel", gtk.RESPONSE_CANCEL,
+			"Select", gtk.RESPONSE_ACCEPT,
+		)
+		if err != nil {
+			log.Fatal("Unable to create file chooser dialog:", err)
+		}
+		filter, err := gtk.FileFilterNew()
+		if err != nil {
+			log.Fatal("Unable to create file filter:", err)
+		}
+		filter.AddPattern("*.csv")
+		filter.AddPattern("*.tsv")
+		filter.AddPattern("*.txt")
+		filter.AddPattern("*.json")
+		filter.AddPattern("*.jsonl")
+		filter.AddPattern("*.ndjson")
+		fileDialog.AddFilter(filter)
+		if fileDialog.Run() == gtk.RESPONSE_ACCEPT {
+			filename := fileDialog.GetFilename()
+			data, table, err := openDataFile(filename)
+			if err != nil {
+				log.Println("Data file error:", err)
+				messageDialog(parent, "Error", "Unable to read data file: "+err.Error())
+			} else {
+				if fileDB != nil {
+					fileDB.Close()
+					sourceCombo.Remove(len(sources) + 1)
 				}
-				iter := store.Append()
-				for i, val := range vals {
-					store.SetValue(iter, i, *(val.(*string)))
+				dataFile, fileTable, fileDB = filename, table, data
+				kind := " (CSV)"
+				if isJSONFile(filename) {
+					kind = " (JSON)"
 				}
+				sourceCombo.Append(fileSourceID, filepath.Base(filename)+kind)
+				sourceCombo.SetActiveID(fileSourceID)
 			}
-			rows.Close()
 		}
-	}
+		fileDialog.Destroy()
+	})
 
 	// Template button
 	templateButton.Connect("clicked", func() {
@@ -850,10 +1358,19 @@ func mailMergeDialog(parent *gtk.Window, db *sql.DB) {
 			log.Fatal("Unable to create file filter:", err)
 		}
 		filter.AddPattern("*.txt")
+		filter.AddPattern("*.rtf")
+		filter.AddPattern("*.docx")
+		filter.AddPattern("*" + nativeExt)
 		fileDialog.AddFilter(filter)
 		if fileDialog.Run() == gtk.RESPONSE_ACCEPT {
 			filename := fileDialog.GetFilename()
 			templateEntry.SetText(filename)
+			// Formatted templates merge to their own format to start with
+			if ext := mergeOutputExt(filename); ext != "" {
+				if entry, err := extCombo.GetEntry(); err == nil {
+					entry.SetText(ext)
+				}
+			}
 		}
 		fileDialog.Destroy()
 	})
@@ -891,7 +1408,9 @@ func mailMergeDialog(parent *gtk.Window, db *sql.DB) {
 	gtk.AddProviderForScreen(screen, cssProvider, gtk.STYLE_PROVIDER_PRIORITY_APPLICATION)
 
 	vbox.ShowAll()
-	if dialog.Run() == gtk.RESPONSE_ACCEPT {
+	// The merge as the dialog stands, or false once told what is missing
+	// or invalid. A dry run needs no output folder.
+	mergeJob := func(validating bool) (MergeJob, bool) {
 		templateFile, err := templateEntry.GetText()
 		if err != nil {
 			log.Fatal("Unable to get entry text:", err)
@@ -900,24 +1419,164 @@ func mailMergeDialog(parent *gtk.Window, db *sql.DB) {
 		if err != nil {
 			log.Fatal("Unable to get entry text:", err)
 		}
-		if templateFile == "" || outputFolder == "" {
+		pattern, err := nameEntry.GetText()
+		if err != nil {
+			log.Fatal("Unable to get entry text:", err)
+		}
+		_, table := source()
+		// The query as it now reads, run or not
+		var queryErr error
+		if sourceCombo.GetActiveID() == customQueryID {
+			if query = queryText(); query != "" {
+				_, queryErr = queryColumns(db, query)
+			} else {
+				table = ""
+			}
+		}
+		var emailErr error
+		if email := emailForm.Options(); email != nil {
+			_, emailErr = newEmailTemplate(*email, previewColumns, filepath.Dir(templateFile))
+		}
+		var labels *LabelLayout
+		var envelope *EnvelopeSize
+		var printErr error
+		switch printCombo.GetActiveID() {
+		case "labels":
+			var layout LabelLayout
+			if layout, printErr = parseLabelLayout(sizeCombo.GetActiveText()); printErr == nil {
+				labels = &layout
+			}
+		case "envelopes":
+			var size EnvelopeSize
+			if size, printErr = parseEnvelopeSize(sizeCombo.GetActiveText()); printErr == nil {
+				envelope = &size
+			}
+		}
+		returnAddress, err := returnEntry.GetText()
+		if err != nil {
+			log.Fatal("Unable to get entry text:", err)
+		}
+		if templateFile == "" || (outputFolder == "" && !validating) {
 			messageDialog(parent, "Error", "Template file and output folder required")
+		} else if table == "" {
+			messageDialog(parent, "Error", "Choose a data source")
+		} else if queryErr != nil {
+			messageDialog(parent, "Error", "Invalid "+queryErr.Error())
+		} else if _, _, err := filter.Filter().Where(); err != nil {
+			messageDialog(parent, "Error", "Invalid filter: "+err.Error())
+		} else if _, err := newOutputNamer(pattern, extCombo.GetActiveText(), previewColumns); err != nil {
+			messageDialog(parent, "Error", "Invalid "+err.Error())
+		} else if emailErr != nil {
+			messageDialog(parent, "Error", "Invalid email: "+emailErr.Error())
+		} else if emailForm.SMTP() != nil && combinedCheck.GetActive() {
+			messageDialog(parent, "Error", "Messages are sent one per record; untick Combine to send")
+		} else if printErr != nil {
+			messageDialog(parent, "Error", "Invalid "+printErr.Error())
+		} else if printCombo.GetActiveID() != "" && emailForm.Options() != nil {
+			messageDialog(parent, "Error", "Labels and envelopes are printed, not emailed; untick Email to print them")
 		} else {
-			// Show progress dialog
-			progressDialog := gtk.MessageDialogNew(parent, gtk.DIALOG_MODAL, gtk.MESSAGE_INFO, gtk.BUTTONS_NONE, "Merging...")
-			go func() {
-				mailMerge(db, templateFile, outputFolder)
-				glib.IdleAdd(func() bool {
-					progressDialog.Destroy()
-					return false
-				})
-			}()
-			progressDialog.Run()
+			file, custom := "", ""
+			switch sourceCombo.GetActiveID() {
+			case fileSourceID:
+				file = dataFile
+			case customQueryID:
+				custom = query
+			}
+			return MergeJob{
+				Table:       table,
+				DataFile:    file,
+				Query:       custom,
+				Filter:      filter.Filter(),
+				Relations:   relations.Relations(),
+				Template:    templateFile,
+				Output:      outputFolder,
+				NamePattern: pattern,
+				Extension:   extCombo.GetActiveText(),
+				Email:       emailForm.Options(),
+				SMTP:        emailForm.SMTP(),
+				// Labels and envelopes are one PDF whatever the check box says
+				Combined:      combinedCheck.GetActive() && labels == nil && envelope == nil,
+				Labels:        labels,
+				Envelope:      envelope,
+				ReturnAddress: strings.ReplaceAll(returnAddress, "|", "\n"),
+			}, true
+		}
+		return MergeJob{}, false
+	}
+	response := dialog.Run()
+	// Validate checks the merge without writing anything and returns to
+	// the dialog
+	for response == gtk.RESPONSE_APPLY {
+		if job, ok := mergeJob(true); ok {
+			report, err := dryRunMerge(context.Background(), db, job)
+			if err != nil {
+				log.Println("Dry run error:", err)
+				messageDialog(parent, "Error", "Validation failed: "+err.Error())
+			} else {
+				dryRunDialog(parent, report)
+			}
+		}
+		response = dialog.Run()
+	}
+	if response == gtk.RESPONSE_ACCEPT {
+		if job, ok := mergeJob(false); ok {
+			switch {
+			case job.Query != "":
+				if job.Query != fields.Query {
+					fields.SetQuery(job.Query)
+				}
+			case job.DataFile == "":
+				if job.Table != fields.Table || fields.Query != "" {
+					fields.SetTable(job.Table)
+				}
+			}
+			report, mergeErr := runMergeWithProgress(parent, db, job)
+			if report != nil {
+				mergeResultsDialog(parent, report)
+			}
+			if mergeErr != nil {
+				log.Println("Mail merge error:", mergeErr)
+				messageDialog(parent, "Error", "Mail merge failed: "+mergeErr.Error())
+			}
 		}
 	}
 	dialog.Destroy()
 }
 
+// Show columns and records in the merge dialog's data preview
+func fillDataPreview(treeView *gtk.TreeView, columns []string, records [][]string) {
+	for treeView.GetNColumns() > 0 {
+		treeView.RemoveColumn(treeView.GetColumn(0))
+	}
+	types := make([]glib.Type, len(columns))
+	for i, name := range columns {
+		types[i] = glib.TYPE_STRING
+		renderer, err := gtk.CellRendererTextNew()
+		if err != nil {
+			log.Fatal("Unable to create cell renderer:", err)
+		}
+		column, err := gtk.TreeViewColumnNew()
+		if err != nil {
+			log.Fatal("Unable to create tree view column:", err)
+		}
+		column.SetTitle(name)
+		column.PackStart(renderer, true)
+		column.AddAttribute(renderer, "text", i)
+		treeView.AppendColumn(column)
+	}
+	store, err := gtk.ListStoreNew(types...)
+	if err != nil {
+		log.Fatal("Unable to create list store:", err)
+	}
+	for _, record := range records {
+		iter := store.Append()
+		for i, val := range record {
+			store.SetValue(iter, i, val)
+		}
+	}
+	treeView.SetModel(store)
+}
+
 // Helper functions
 func colNames(columns []Column) []string {
 	names := make([]string, len(columns))
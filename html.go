@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Write document as a standalone HTML page. Pending deletions are left out.
+func saveHTML(filename string, doc *Document) error {
+	return os.WriteFile(filename, []byte(documentHTML(doc)), 0644)
+}
+
+func documentHTML(doc *Document) string {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&b, "<title>%s</title>\n", html.EscapeString(doc.Props.Title))
+	for _, meta := range []struct{ name, content string }{
+		{"author", doc.Props.Author},
+		{"description", doc.Props.Subject},
+		{"keywords", doc.Props.Keywords},
+	} {
+		if meta.content != "" {
+			fmt.Fprintf(&b, "<meta name=\"%s\" content=\"%s\">\n", meta.name, html.EscapeString(meta.content))
+		}
+	}
+	b.WriteString("</head>\n<body>\n")
+	for _, p := range doc.Paragraphs() {
+		if p.PageBreak() {
+			b.WriteString("<div style=\"break-after: page\"></div>\n")
+			continue
+		}
+		if p.Align() == "center" {
+			b.WriteString(`<p style="text-align: center">`)
+		} else {
+			b.WriteString("<p>")
+		}
+		for _, r := range p.Runs {
+			if r.Change != nil && r.Change.Kind == ChangeDelete {
+				continue
+			}
+			b.WriteString(htmlRun(r))
+		}
+		b.WriteString("</p>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+	return b.String()
+}
+
+func htmlRun(r Run) string {
+	text := html.EscapeString(r.Text)
+	// Keep runs of spaces
+	text = strings.ReplaceAll(text, "  ", " &nbsp;")
+	if _, ok := r.Tags["bold"]; ok {
+		text = "<b>" + text + "</b>"
+	}
+	if _, ok := r.Tags["italic"]; ok {
+		text = "<i>" + text + "</i>"
+	}
+	if size, ok := r.Tags["size"]; ok && size != "" {
+		text = fmt.Sprintf(`<span style="font-size: %spt">%s</span>`, size, text)
+	}
+	if url, ok := r.Tags["link"]; ok {
+		text = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(url), text)
+	}
+	return text
+}
+
+// Elements that start a new line
+var htmlBlocks = map[string]bool{
+	"p": true, "div": true, "li": true, "tr": true, "blockquote": true, "pre": true,
+	"ul": true, "ol": true, "table": true, "h1": true, "h2": true, "h3": true,
+	"h4": true, "h5": true, "h6": true, "section": true, "article": true,
+}
+
+// Elements whose content is not text
+var htmlSkipped = map[string]bool{"head": true, "title": true, "script": true, "style": true}
+
+// parseHTML turns an HTML fragment, as browsers and word processors put
+// on the clipboard, into text with bold, italic, size, center and link
+// tags. Other markup is reduced to its text.
+func parseHTML(s string) *Document {
+	d := xml.NewDecoder(strings.NewReader(s))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	type element struct {
+		name  string
+		start int
+		tags  []TagSpan // tags the element opens; offsets filled in on close
+	}
+	var stack []element
+	var out []rune
+	var tags []TagSpan
+	skip, pre := 0, 0
+	newline := func() {
+		for len(out) > 0 && out[len(out)-1] == ' ' {
+			out = out[:len(out)-1]
+		}
+		if len(out) > 0 && out[len(out)-1] != '\n' {
+			out = append(out, '\n')
+		}
+	}
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			el := element{name: name}
+			switch name {
+			case "b", "strong", "h1", "h2", "h3":
+				el.tags = append(el.tags, TagSpan{Tag: "bold"})
+			case "i", "em":
+				el.tags = append(el.tags, TagSpan{Tag: "italic"})
+			case "br":
+				out = append(out, '\n')
+			case "pre":
+				pre++
+			}
+			if htmlSkipped[name] {
+				skip++
+			}
+			if htmlBlocks[name] {
+				newline()
+			}
+			for _, attr := range t.Attr {
+				switch strings.ToLower(attr.Name.Local) {
+				case "href":
+					if name == "a" && attr.Value != "" {
+						el.tags = append(el.tags, TagSpan{Tag: "link", Value: attr.Value})
+					}
+				case "style":
+					el.tags = append(el.tags, htmlStyleTags(attr.Value, htmlBlocks[name])...)
+				case "align":
+					if htmlBlocks[name] && strings.EqualFold(attr.Value, "center") {
+						el.tags = append(el.tags, TagSpan{Tag: "center"})
+					}
+				}
+			}
+			el.start = len(out)
+			stack = append(stack, el)
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			for len(stack) > 0 {
+				el := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				for _, tag := range el.tags {
+					tag.Start, tag.End = el.start, len(out)
+					tags = append(tags, tag)
+				}
+				if htmlSkipped[el.name] {
+					skip--
+				}
+				if el.name == "pre" {
+					pre--
+				}
+				if htmlBlocks[el.name] {
+					// An empty paragraph is a blank line
+					if el.name == "p" && el.start == len(out) && len(out) > 0 {
+						out = append(out, '\n')
+					}
+					newline()
+				}
+				if el.name == name {
+					break
+				}
+			}
+		case xml.CharData:
+			if skip > 0 {
+				continue
+			}
+			for _, r := range string(t) {
+				switch {
+				case pre > 0:
+					out = append(out, r)
+				case r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f':
+					if len(out) > 0 && out[len(out)-1] != ' ' && out[len(out)-1] != '\n' {
+						out = append(out, ' ')
+					}
+				case r == ' ':
+					out = append(out, ' ')
+				default:
+					out = append(out, r)
+				}
+			}
+		}
+	}
+
+	for len(out) > 0 && (out[len(out)-1] == '\n' || out[len(out)-1] == ' ') {
+		out = out[:len(out)-1]
+	}
+	doc := &Document{Text: string(out)}
+	for _, tag := range tags {
+		tag.Start, tag.End = clamp(tag.Start, 0, len(out)), clamp(tag.End, 0, len(out))
+		if tag.Start < tag.End {
+			doc.Tags = append(doc.Tags, tag)
+		}
+	}
+	return doc
+}
+
+// Tags for the inline style properties GoATPAD knows
+func htmlStyleTags(style string, block bool) []TagSpan {
+	var tags []TagSpan
+	for _, decl := range strings.Split(style, ";") {
+		key, value, ok := strings.Cut(decl, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.ToLower(strings.TrimSpace(value))
+		switch key {
+		case "font-weight":
+			if weight, err := strconv.Atoi(value); value == "bold" || value == "bolder" || err == nil && weight >= 600 {
+				tags = append(tags, TagSpan{Tag: "bold"})
+			}
+		case "font-style":
+			if value == "italic" || value == "oblique" {
+				tags = append(tags, TagSpan{Tag: "italic"})
+			}
+		case "font-size":
+			scale := 0.0
+			switch {
+			case strings.HasSuffix(value, "pt"):
+				scale = 1
+			case strings.HasSuffix(value, "px"):
+				scale = 0.75
+			}
+			// 12 pt is the editor's normal size, not a size tag
+			if size, err := strconv.ParseFloat(strings.TrimSpace(value[:max(len(value)-2, 0)]), 64); err == nil && scale > 0 && size*scale != 12 {
+				tags = append(tags, TagSpan{Tag: "size", Value: strconv.FormatFloat(size*scale, 'f', -1, 64)})
+			}
+		case "text-align":
+			if block && value == "center" {
+				tags = append(tags, TagSpan{Tag: "center"})
+			}
+		}
+	}
+	return tags
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// JSON sources are flattened into columns: nested values get dotted
+// names like address.city and lists keep their JSON in a column marked
+// with [], like items[]. mergeData puts the structure back for templates.
+const jsonListSuffix = "[]"
+
+// A JSON array of records, or JSON Lines with a record per line
+func isJSONFile(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json", ".jsonl", ".ndjson":
+		return true
+	}
+	return false
+}
+
+// An object with its keys in file order
+type jsonObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (o *jsonObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := encodeJSON(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := encodeJSON(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Read the next value from dec, objects as *jsonObject and numbers as
+// json.Number
+func decodeJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := &jsonObject{values: map[string]interface{}{}}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := tok.(string)
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := obj.values[key]; !dup {
+				obj.keys = append(obj.keys, key)
+			}
+			obj.values[key] = v
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		list := []interface{}{}
+		for dec.More() {
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		_, err := dec.Token()
+		return list, err
+	}
+	return tok, nil
+}
+
+// readJSON reads a JSON array of objects, or a stream of objects such as
+// JSON Lines, as columns and records. Columns come in the order they
+// are first seen; records without one have it empty.
+func readJSON(filename string) ([]string, [][]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	text, _, err := decodeText(data, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	var objects []*jsonObject
+	for {
+		v, err := decodeJSONValue(dec)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		switch v := v.(type) {
+		case []interface{}:
+			for i, item := range v {
+				obj, ok := item.(*jsonObject)
+				if !ok {
+					return nil, nil, fmt.Errorf("item %d of the array is not an object", i+1)
+				}
+				objects = append(objects, obj)
+			}
+		case *jsonObject:
+			objects = append(objects, v)
+		default:
+			return nil, nil, fmt.Errorf("expected an array of objects or an object per line, found %s", jsonKind(v))
+		}
+	}
+	if len(objects) == 0 {
+		return nil, nil, fmt.Errorf("%s has no records", filepath.Base(filename))
+	}
+
+	var columns []string
+	index := map[string]int{}
+	var records [][]string
+	for _, obj := range objects {
+		var names, values []string
+		if err := flattenJSON("", obj, &names, &values); err != nil {
+			return nil, nil, err
+		}
+		record := make([]string, len(columns), len(columns)+len(names))
+		for i, name := range names {
+			if _, ok := index[name]; !ok {
+				index[name] = len(columns)
+				columns = append(columns, name)
+				record = append(record, "")
+			}
+			record[index[name]] = values[i]
+		}
+		records = append(records, record)
+	}
+	// Records from before a column first appeared lack it
+	for i := range records {
+		for len(records[i]) < len(columns) {
+			records[i] = append(records[i], "")
+		}
+	}
+	return columns, records, nil
+}
+
+// Flatten obj into names and values under prefix
+func flattenJSON(prefix string, obj *jsonObject, names, values *[]string) error {
+	for _, key := range obj.keys {
+		name := prefix + key
+		switch v := obj.values[key].(type) {
+		case *jsonObject:
+			if err := flattenJSON(name+".", v, names, values); err != nil {
+				return err
+			}
+		case []interface{}:
+			list, err := encodeJSON(v)
+			if err != nil {
+				return err
+			}
+			*names = append(*names, name+jsonListSuffix)
+			*values = append(*values, string(list))
+		default:
+			*names = append(*names, name)
+			*values = append(*values, jsonString(v))
+		}
+	}
+	return nil
+}
+
+// Compact JSON for v, leaving <, > and & as they are
+func encodeJSON(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+// A JSON scalar as a merge value: numbers as written, null as empty
+func jsonString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "a string"
+	case json.Number:
+		return "a number"
+	case bool:
+		return "true or false"
+	}
+	return "null"
+}
+
+// mergeData is a record as templates see it: every column by name, and
+// the nested fields and lists of JSON sources in their places, so
+// {{.address.city}} and {{range .items}} work. Values are all strings,
+// as from any other source.
+func mergeData(columns, values []string) map[string]interface{} {
+	data := make(map[string]interface{}, len(columns))
+	for i, col := range columns {
+		data[col] = values[i]
+	}
+	for i, col := range columns {
+		var value interface{} = values[i]
+		path := col
+		if strings.HasSuffix(col, jsonListSuffix) {
+			path = strings.TrimSuffix(col, jsonListSuffix)
+			var list interface{}
+			dec := json.NewDecoder(strings.NewReader(values[i]))
+			dec.UseNumber()
+			if values[i] == "" || dec.Decode(&list) != nil {
+				list = []interface{}{}
+			}
+			value = jsonStrings(list)
+		} else if !strings.Contains(col, ".") {
+			continue
+		}
+		setPath(data, strings.Split(path, "."), value)
+	}
+	return data
+}
+
+// Put value at path in data, unless a column already holds part of it
+func setPath(data map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := data[key].(map[string]interface{})
+		if !ok {
+			if _, taken := data[key]; taken {
+				return
+			}
+			next = map[string]interface{}{}
+			data[key] = next
+		}
+		data = next
+	}
+	last := path[len(path)-1]
+	if _, taken := data[last]; !taken {
+		data[last] = value
+	}
+}
+
+// Decoded JSON with every scalar turned into a merge value
+func jsonStrings(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = jsonStrings(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonStrings(item)
+		}
+		return v
+	}
+	return jsonString(v)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Lengths in points
+const (
+	pointsPerInch = 72.0
+	pointsPerMM   = 72.0 / 25.4
+)
+
+// Label padding unless a layout says otherwise
+const defaultLabelPadding = 6.0
+
+// Paper sizes for custom label layouts
+var paperSizes = map[string][2]float64{
+	"letter": {612, 792},
+	"legal":  {612, 1008},
+	"a4":     {210 * pointsPerMM, 297 * pointsPerMM},
+	"a5":     {148 * pointsPerMM, 210 * pointsPerMM},
+}
+
+// LabelLayout is a sheet of labels in a grid. Lengths are in points;
+// the pitch is from one label's edge to the same edge of the next.
+type LabelLayout struct {
+	Name                           string
+	PageWidth, PageHeight          float64
+	Columns, Rows                  int
+	TopMargin, LeftMargin          float64
+	Width, Height                  float64
+	HorizontalPitch, VerticalPitch float64
+	Padding                        float64 // kept clear inside each label
+}
+
+// Avery sheets
+var labelPresets = []LabelLayout{
+	avery("5160", 612, 792, 3, 10, 0.5, 0.1875, 2.625, 1, 2.75, 1, pointsPerInch),
+	avery("5161", 612, 792, 2, 10, 0.5, 0.15625, 4, 1, 4.1875, 1, pointsPerInch),
+	avery("5162", 612, 792, 2, 7, 0.83, 0.15625, 4, 1.333, 4.1875, 1.333, pointsPerInch),
+	avery("5163", 612, 792, 2, 5, 0.5, 0.15625, 4, 2, 4.1875, 2, pointsPerInch),
+	avery("5164", 612, 792, 2, 3, 0.5, 0.15625, 4, 3.333, 4.1875, 3.333, pointsPerInch),
+	avery("5167", 612, 792, 4, 20, 0.5, 0.28125, 1.75, 0.5, 2.0625, 0.5, pointsPerInch),
+	avery("L7160", 595.28, 841.89, 3, 7, 15.15, 7.25, 63.5, 38.1, 66.04, 38.1, pointsPerMM),
+	avery("L7161", 595.28, 841.89, 3, 6, 8.85, 7.25, 63.5, 46.6, 66.04, 46.6, pointsPerMM),
+	avery("L7162", 595.28, 841.89, 2, 8, 12.9, 4.65, 99.1, 33.9, 101.6, 33.9, pointsPerMM),
+	avery("L7163", 595.28, 841.89, 2, 7, 15.15, 4.65, 99.1, 38.1, 101.6, 38.1, pointsPerMM),
+}
+
+func avery(name string, pageWidth, pageHeight float64, columns, rows int, top, left, width, height, hpitch, vpitch, unit float64) LabelLayout {
+	return LabelLayout{
+		Name: name, PageWidth: pageWidth, PageHeight: pageHeight,
+		Columns: columns, Rows: rows,
+		TopMargin: top * unit, LeftMargin: left * unit,
+		Width: width * unit, Height: height * unit,
+		HorizontalPitch: hpitch * unit, VerticalPitch: vpitch * unit,
+		Padding: defaultLabelPadding,
+	}
+}
+
+// EnvelopeSize is an envelope, printed landscape, in points
+type EnvelopeSize struct {
+	Name          string
+	Width, Height float64
+}
+
+var envelopePresets = []EnvelopeSize{
+	{"#10", 9.5 * pointsPerInch, 4.125 * pointsPerInch},
+	{"#9", 8.875 * pointsPerInch, 3.875 * pointsPerInch},
+	{"Monarch", 7.5 * pointsPerInch, 3.875 * pointsPerInch},
+	{"DL", 220 * pointsPerMM, 110 * pointsPerMM},
+	{"C5", 229 * pointsPerMM, 162 * pointsPerMM},
+	{"C6", 162 * pointsPerMM, 114 * pointsPerMM},
+}
+
+var (
+	gridRe   = regexp.MustCompile(`^(\d+)x(\d+)$`)
+	lengthRe = regexp.MustCompile(`^([0-9]*\.?[0-9]+)(in|mm|cm|pt)?$`)
+)
+
+// A length such as 0.5in, 12.7mm or 36pt; bare numbers are points
+func parseLength(s string) (float64, error) {
+	m := lengthRe.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, fmt.Errorf("invalid length %q: use a number with in, mm, cm or pt", s)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	switch m[2] {
+	case "in":
+		n *= pointsPerInch
+	case "mm":
+		n *= pointsPerMM
+	case "cm":
+		n *= 10 * pointsPerMM
+	}
+	return n, nil
+}
+
+// A page size: letter, legal, a4, a5 or WIDTHxHEIGHT, e.g. 8.5inx11in
+func parsePageSize(s string) (width, height float64, err error) {
+	if size, ok := paperSizes[strings.ToLower(s)]; ok {
+		return size[0], size[1], nil
+	}
+	w, h, ok := strings.Cut(strings.ToLower(s), "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown page size %q", s)
+	}
+	if width, err = parseLength(w); err != nil {
+		return 0, 0, err
+	}
+	if height, err = parseLength(h); err != nil {
+		return 0, 0, err
+	}
+	return width, height, nil
+}
+
+// parseLabelLayout reads a preset name such as 5160 or L7163, or a custom
+// grid such as "letter 3x10 top=0.5in left=0.1875in width=2.625in
+// height=1in hpitch=2.75in vpitch=1in": the page, columns x rows, then
+// any of top, left, width, height, hpitch, vpitch and padding. Labels
+// left out fill the page between the margins; pitches left out are the
+// label sizes.
+func parseLabelLayout(spec string) (LabelLayout, error) {
+	spec = strings.TrimSpace(spec)
+	for _, preset := range labelPresets {
+		if strings.EqualFold(strings.TrimPrefix(strings.ToLower(spec), "avery "), preset.Name) {
+			return preset, nil
+		}
+	}
+	layout := LabelLayout{Name: spec, Padding: defaultLabelPadding}
+	for _, field := range strings.Fields(spec) {
+		key, value, hasValue := strings.Cut(field, "=")
+		if !hasValue {
+			if m := gridRe.FindStringSubmatch(strings.ToLower(field)); m != nil {
+				layout.Columns, _ = strconv.Atoi(m[1])
+				layout.Rows, _ = strconv.Atoi(m[2])
+				continue
+			}
+			w, h, err := parsePageSize(field)
+			if err != nil {
+				return LabelLayout{}, fmt.Errorf("labels %q: %w", spec, err)
+			}
+			layout.PageWidth, layout.PageHeight = w, h
+			continue
+		}
+		lengths := map[string]*float64{
+			"top": &layout.TopMargin, "left": &layout.LeftMargin,
+			"width": &layout.Width, "height": &layout.Height,
+			"hpitch": &layout.HorizontalPitch, "vpitch": &layout.VerticalPitch,
+			"padding": &layout.Padding,
+		}
+		target, ok := lengths[strings.ToLower(key)]
+		if !ok {
+			return LabelLayout{}, fmt.Errorf("labels %q: unknown setting %q", spec, key)
+		}
+		n, err := parseLength(value)
+		if err != nil {
+			return LabelLayout{}, fmt.Errorf("labels %q: %s: %w", spec, key, err)
+		}
+		*target = n
+	}
+	if layout.PageWidth == 0 {
+		return LabelLayout{}, fmt.Errorf("unknown labels %q: give a preset such as 5160, or a page size and grid such as \"letter 3x10\"", spec)
+	}
+	if layout.Columns < 1 || layout.Rows < 1 {
+		return LabelLayout{}, fmt.Errorf("labels %q: no grid, e.g. 3x10 for 3 columns of 10", spec)
+	}
+	fill := func(size, pitch *float64, page, margin float64, count int) {
+		if *size == 0 && *pitch == 0 {
+			*size = (page - 2*margin) / float64(count)
+		}
+		if *size == 0 {
+			*size = *pitch
+		}
+		if *pitch == 0 {
+			*pitch = *size
+		}
+	}
+	fill(&layout.Width, &layout.HorizontalPitch, layout.PageWidth, layout.LeftMargin, layout.Columns)
+	fill(&layout.Height, &layout.VerticalPitch, layout.PageHeight, layout.TopMargin, layout.Rows)
+	if err := layout.check(); err != nil {
+		return LabelLayout{}, fmt.Errorf("labels %q: %w", spec, err)
+	}
+	return layout, nil
+}
+
+// check that the labels are on the page and clear of each other
+func (l LabelLayout) check() error {
+	const slack = 1 // rounding in published sizes
+	switch {
+	case l.Width <= 0 || l.Height <= 0:
+		return fmt.Errorf("the margins leave no room for labels")
+	case l.Width <= 2*l.Padding || l.Height <= 2*l.Padding:
+		return fmt.Errorf("labels too small for their padding")
+	case l.HorizontalPitch < l.Width-slack || l.VerticalPitch < l.Height-slack:
+		return fmt.Errorf("labels overlap: the pitch is less than the label size")
+	case l.LeftMargin+float64(l.Columns-1)*l.HorizontalPitch+l.Width > l.PageWidth+slack:
+		return fmt.Errorf("%d columns do not fit across the page", l.Columns)
+	case l.TopMargin+float64(l.Rows-1)*l.VerticalPitch+l.Height > l.PageHeight+slack:
+		return fmt.Errorf("%d rows do not fit down the page", l.Rows)
+	}
+	return nil
+}
+
+// parseEnvelopeSize reads a preset name such as #10 or DL, or a size
+// such as 9.5inx4.125in. Envelopes are always landscape.
+func parseEnvelopeSize(spec string) (EnvelopeSize, error) {
+	spec = strings.TrimSpace(spec)
+	for _, preset := range envelopePresets {
+		if strings.EqualFold(spec, preset.Name) {
+			return preset, nil
+		}
+	}
+	w, h, err := parsePageSize(spec)
+	if err != nil {
+		return EnvelopeSize{}, fmt.Errorf("unknown envelope %q: give a size such as #10, DL or 9.5inx4.125in", spec)
+	}
+	if w < h {
+		w, h = h, w
+	}
+	if h < 2*pointsPerInch {
+		return EnvelopeSize{}, fmt.Errorf("envelope %q is too small", spec)
+	}
+	return EnvelopeSize{Name: spec, Width: w, Height: h}, nil
+}
+
+// labelsPDF prints docs one per label, across and then down each sheet.
+// Text too big for a label is cut off at its edge.
+func labelsPDF(layout LabelLayout, docs []*Document) []byte {
+	p := &PDF{Width: layout.PageWidth, Height: layout.PageHeight}
+	if len(docs) > 0 {
+		p.Info = docs[0].Props
+	}
+	perPage := layout.Columns * layout.Rows
+	for i, doc := range docs {
+		if i%perPage == 0 {
+			p.AddPage()
+		}
+		row, col := i%perPage/layout.Columns, i%layout.Columns
+		x := layout.LeftMargin + float64(col)*layout.HorizontalPitch
+		top := layout.PageHeight - layout.TopMargin - float64(row)*layout.VerticalPitch
+		p.Clip(x, top-layout.Height, x+layout.Width, top)
+		layoutBox(p, doc, x+layout.Padding, top-layout.Padding,
+			layout.Width-2*layout.Padding, layout.Height-2*layout.Padding, true)
+		p.Unclip()
+	}
+	return p.Bytes()
+}
+
+// envelopesPDF prints docs one per envelope as the delivery address, with
+// returnAddress, lines separated by newlines, in the top left corner
+func envelopesPDF(size EnvelopeSize, returnAddress string, docs []*Document) []byte {
+	p := &PDF{Width: size.Width, Height: size.Height}
+	if len(docs) > 0 {
+		p.Info = docs[0].Props
+	}
+	const edge = 0.375 * pointsPerInch
+	left := size.Width * 0.45
+	top := size.Height * 0.55
+	from := &Document{Text: strings.TrimSpace(returnAddress)}
+	for _, doc := range docs {
+		p.AddPage()
+		if from.Text != "" {
+			p.Clip(0, top, left, size.Height)
+			layoutBox(p, from, edge, size.Height-edge, left-2*edge, size.Height-top-edge, false)
+			p.Unclip()
+		}
+		p.Clip(left, 0, size.Width, top)
+		layoutBox(p, doc, left, top, size.Width-left-edge, top-edge, false)
+		p.Unclip()
+	}
+	return p.Bytes()
+}
+
+// Flow the paragraphs of doc into the box below x, top, dropping lines
+// that do not fit and ignoring page breaks. middle centres the text
+// down the box.
+func layoutBox(p *PDF, doc *Document, x, top, width, height float64, middle bool) {
+	type boxLine struct {
+		pieces []pdfPiece
+		height float64
+		width  float64
+		center bool
+	}
+	var lines []boxLine
+	used := 0.0
+	paras := doc.Paragraphs()
+	// A template's trailing newline is not a blank line to centre
+	for len(paras) > 1 && len(paras[len(paras)-1].Runs) == 0 {
+		paras = paras[:len(paras)-1]
+	}
+fill:
+	for _, para := range paras {
+		if para.PageBreak() {
+			continue
+		}
+		for _, line := range paragraphLines(para, width) {
+			h, w := lineSize(line)
+			if used+h > height {
+				break fill
+			}
+			used += h
+			lines = append(lines, boxLine{line, h, w, para.Align() == "center"})
+		}
+	}
+	y := top
+	if middle {
+		y -= (height - used) / 2
+	}
+	for _, line := range lines {
+		y -= line.height
+		lx := x
+		if line.center {
+			lx += (width - line.width) / 2
+		}
+		drawLine(p, line.pieces, lx, y, line.height)
+	}
+}
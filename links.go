@@ -0,0 +1,197 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gotk3/gotk3/gdk"
+	"github.com/gotk3/gotk3/gtk"
+	"github.com/gotk3/gotk3/pango"
+)
+
+// Links keeps the hyperlinks of the document. Every link has its own tag
+// so the URL travels with the text it is attached to.
+type Links struct {
+	buffer   *gtk.TextBuffer
+	tagTable *gtk.TextTagTable
+	tags     map[int]*gtk.TextTag
+	urls     map[int]string
+	nextID   int
+}
+
+func newLinks(buffer *gtk.TextBuffer, tagTable *gtk.TextTagTable) *Links {
+	return &Links{
+		buffer:   buffer,
+		tagTable: tagTable,
+		tags:     map[int]*gtk.TextTag{},
+		urls:     map[int]string{},
+		nextID:   1,
+	}
+}
+
+// Add links start..end to url, replacing links already in that range
+func (l *Links) Add(start, end *gtk.TextIter, url string) {
+	for _, tag := range l.tags {
+		l.buffer.RemoveTag(tag, start, end)
+	}
+	tag, err := gtk.TextTagNew("link-" + strconv.Itoa(l.nextID))
+	if err != nil {
+		log.Println("Create tag error:", err)
+		return
+	}
+	tag.SetProperty("foreground", "#0000EE")
+	tag.SetProperty("underline", pango.UNDERLINE_SINGLE)
+	l.tagTable.Add(tag)
+	l.tags[l.nextID] = tag
+	l.urls[l.nextID] = url
+	l.nextID++
+	l.buffer.ApplyTag(tag, start, end)
+	l.prune()
+}
+
+// At returns the link under iter
+func (l *Links) At(iter *gtk.TextIter) (id int, url string, ok bool) {
+	for id, tag := range l.tags {
+		if iter.HasTag(tag) {
+			return id, l.urls[id], true
+		}
+	}
+	return 0, "", false
+}
+
+func (l *Links) Remove(id int) {
+	if tag, ok := l.tags[id]; ok {
+		start, end := l.buffer.GetBounds()
+		l.buffer.RemoveTag(tag, start, end)
+		l.tagTable.Remove(tag)
+	}
+	delete(l.tags, id)
+	delete(l.urls, id)
+}
+
+// Drop links whose text has gone entirely
+func (l *Links) prune() {
+	for id, tag := range l.tags {
+		if len(tagRanges(l.buffer, tag)) == 0 {
+			l.Remove(id)
+		}
+	}
+}
+
+// Spans returns the links as "link" tag spans carrying the URL
+func (l *Links) Spans() []TagSpan {
+	var spans []TagSpan
+	for id, tag := range l.tags {
+		for _, r := range tagRanges(l.buffer, tag) {
+			spans = append(spans, TagSpan{Tag: "link", Start: r[0], End: r[1], Value: l.urls[id]})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+	return spans
+}
+
+func (l *Links) Reset() {
+	for id := range l.tags {
+		l.Remove(id)
+	}
+	l.nextID = 1
+}
+
+// Insert or edit the link on the selection or under the cursor
+func hyperlinkDialog(parent *gtk.Window, ed *Editor) {
+	start, end, ok := ed.buffer.GetSelectionBounds()
+	id, url, onLink := ed.links.At(ed.buffer.GetIterAtMark(ed.buffer.GetInsert()))
+	if !ok && !onLink {
+		messageDialog(parent, "Error", "Select the text to link")
+		return
+	}
+
+	dialog, err := gtk.DialogNew()
+	if err != nil {
+		log.Fatal("Unable to create dialog:", err)
+	}
+	dialog.SetTitle("Hyperlink")
+	dialog.SetTransientFor(parent)
+	dialog.SetModal(true)
+	dialog.AddButton("OK", gtk.RESPONSE_ACCEPT)
+	if onLink {
+		dialog.AddButton("Remove Link", gtk.RESPONSE_REJECT)
+	}
+	dialog.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+
+	vbox, err := dialog.GetContentArea()
+	if err != nil {
+		log.Fatal("Unable to get content area:", err)
+	}
+	label, err := gtk.LabelNew("URL (https://... or mailto:...):")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	entry, err := gtk.EntryNew()
+	if err != nil {
+		log.Fatal("Unable to create entry:", err)
+	}
+	entry.SetText(url)
+	entry.SetActivatesDefault(true)
+	dialog.SetDefaultResponse(gtk.RESPONSE_ACCEPT)
+	vbox.PackStart(label, false, false, 5)
+	vbox.PackStart(entry, false, false, 5)
+	vbox.ShowAll()
+
+	response := dialog.Run()
+	if response == gtk.RESPONSE_ACCEPT {
+		newURL, err := entry.GetText()
+		if err != nil {
+			log.Fatal("Unable to get entry text:", err)
+		}
+		newURL = strings.TrimSpace(newURL)
+		if newURL == "" {
+			messageDialog(parent, "Error", "URL cannot be empty")
+		} else if ok {
+			ed.links.Add(start, end, newURL)
+		} else {
+			ed.links.urls[id] = newURL
+		}
+	} else if response == gtk.RESPONSE_REJECT {
+		ed.links.Remove(id)
+	}
+	dialog.Destroy()
+}
+
+// Ctrl+click on a link opens it in the desktop's handler
+func setupLinkClicks(ed *Editor) {
+	ed.textView.Connect("button-release-event", func(tv *gtk.TextView, ev *gdk.Event) bool {
+		button := gdk.EventButtonNewFromEvent(ev)
+		if button.Button() != gdk.BUTTON_PRIMARY || button.State()&uint(gdk.CONTROL_MASK) == 0 {
+			return false
+		}
+		x, y := tv.WindowToBufferCoords(gtk.TEXT_WINDOW_WIDGET, int(button.X()), int(button.Y()))
+		_, url, ok := ed.links.At(tv.GetIterAtLocation(x, y))
+		if !ok {
+			return false
+		}
+		openURL(url)
+		return true
+	})
+}
+
+func openURL(url string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	case "darwin":
+		cmd = exec.Command("open", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		log.Println("Open link error:", err)
+		return
+	}
+	go cmd.Wait()
+}
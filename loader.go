@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/gotk3/gotk3/glib"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+const (
+	loadChunkSize = 1 << 20
+	// Larger files open read-only unless the user asks otherwise; editing
+	// them keeps the tracker, comments and status bar busy on every key.
+	largeFileSize = 50 << 20
+)
+
+// openTextFile streams a plain text file into the editor a chunk at a
+// time from idle callbacks, so the window stays responsive, with a
+// progress dialog that can cancel the load. An empty encoding means
+// detect it.
+func openTextFile(parent *gtk.Window, ed *Editor, filename, encoding string) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		log.Println("Open error:", err)
+		messageDialog(parent, "Error", "Unable to open: "+err.Error())
+		return
+	}
+	size := info.Size()
+	readOnly := false
+	if size > largeFileSize {
+		var ok bool
+		if readOnly, ok = largeFileDialog(parent, size); !ok {
+			return
+		}
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Println("Open error:", err)
+		messageDialog(parent, "Error", "Unable to open: "+err.Error())
+		return
+	}
+	if encoding == "" {
+		sample := make([]byte, 64<<10)
+		n, _ := io.ReadFull(file, sample)
+		sample = sample[:n]
+		if int64(n) < size {
+			sample = sample[:n-incompleteUTF8(sample)]
+		}
+		encoding = detectEncoding(sample)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			log.Println("Open error:", err)
+			file.Close()
+			return
+		}
+	}
+
+	dialog, progress := loadProgressDialog(parent, filename)
+	ctx, cancel := context.WithCancel(context.Background())
+	dialog.Connect("response", func() {
+		cancel()
+	})
+	dialog.ShowAll()
+
+	ed.SetText("")
+	ed.SetReadOnly(true)
+	ed.loading = true
+	ed.tracker.busy = true
+	finish := func(format TextFormat, err error) {
+		ed.tracker.busy = false
+		ed.loading = false
+		dialog.Destroy()
+		if err != nil || ctx.Err() != nil {
+			ed.SetText("")
+			ed.SetReadOnly(false)
+			if err != nil {
+				log.Println("Open error:", err)
+				messageDialog(parent, "Error", "Unable to open: "+err.Error())
+			}
+			return
+		}
+		ed.format = format
+		ed.SetReadOnly(readOnly)
+		ed.fields.Validate()
+	}
+
+	go func() {
+		defer file.Close()
+		dec := &textDecoder{Encoding: encoding}
+		buf := make([]byte, loadChunkSize)
+		var read int64
+		for {
+			n, err := io.ReadFull(file, buf)
+			final := err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !final {
+				glib.IdleAdd(func() bool {
+					finish(TextFormat{}, err)
+					return false
+				})
+				return
+			}
+			read += int64(n)
+			text, err := dec.Decode(buf[:n], final)
+			if err != nil {
+				glib.IdleAdd(func() bool {
+					finish(TextFormat{}, err)
+					return false
+				})
+				return
+			}
+			// Wait for each chunk to be inserted before reading the next
+			done := make(chan struct{})
+			fraction := float64(read) / float64(max(size, 1))
+			glib.IdleAdd(func() bool {
+				defer close(done)
+				if ctx.Err() != nil {
+					return false
+				}
+				ed.buffer.Insert(ed.buffer.GetEndIter(), text)
+				progress.SetFraction(fraction)
+				progress.SetText(fmt.Sprintf("%.1f of %.1f MB", float64(read)/(1<<20), float64(size)/(1<<20)))
+				return false
+			})
+			select {
+			case <-done:
+			case <-ctx.Done():
+			}
+			if final || ctx.Err() != nil {
+				format := dec.Format()
+				glib.IdleAdd(func() bool {
+					finish(format, nil)
+					return false
+				})
+				return
+			}
+		}
+	}()
+}
+
+// Ask how to open a file above largeFileSize. ok is false on cancel.
+func largeFileDialog(parent *gtk.Window, size int64) (readOnly, ok bool) {
+	dialog, err := gtk.DialogNew()
+	if err != nil {
+		log.Fatal("Unable to create dialog:", err)
+	}
+	dialog.SetTitle("Large File")
+	dialog.SetTransientFor(parent)
+	dialog.SetModal(true)
+	dialog.AddButton("Open Read-Only", gtk.RESPONSE_ACCEPT)
+	dialog.AddButton("Open for Editing", gtk.RESPONSE_APPLY)
+	dialog.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+	dialog.SetDefaultResponse(gtk.RESPONSE_ACCEPT)
+
+	vbox, err := dialog.GetContentArea()
+	if err != nil {
+		log.Fatal("Unable to get content area:", err)
+	}
+	label, err := gtk.LabelNew(fmt.Sprintf(
+		"This file is %.0f MB. Editing files this large can be slow,\nso it is best opened read-only.",
+		float64(size)/(1<<20)))
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	vbox.PackStart(label, false, false, 10)
+	vbox.ShowAll()
+
+	response := dialog.Run()
+	dialog.Destroy()
+	return response == gtk.RESPONSE_ACCEPT, response == gtk.RESPONSE_ACCEPT || response == gtk.RESPONSE_APPLY
+}
+
+func loadProgressDialog(parent *gtk.Window, filename string) (*gtk.Dialog, *gtk.ProgressBar) {
+	dialog, err := gtk.DialogNew()
+	if err != nil {
+		log.Fatal("Unable to create dialog:", err)
+	}
+	dialog.SetTitle("Opening " + filename)
+	dialog.SetTransientFor(parent)
+	dialog.SetModal(true)
+	dialog.SetDefaultSize(400, -1)
+	dialog.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+
+	vbox, err := dialog.GetContentArea()
+	if err != nil {
+		log.Fatal("Unable to get content area:", err)
+	}
+	progress, err := gtk.ProgressBarNew()
+	if err != nil {
+		log.Fatal("Unable to create progress bar:", err)
+	}
+	progress.SetShowText(true)
+	vbox.PackStart(progress, false, false, 10)
+	return dialog, progress
+}
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// MergeJob describes one mail merge run
+type MergeJob struct {
+	Table    string
+	DataFile string // CSV, JSON or JSON Lines file to read instead of Table
+	Query    string // read-only SELECT to merge the results of instead of Table
+	// Child rows for each record, from other tables of the database
+	Relations []Relation
+	Filter    Filter
+	Template  string // template file: plain text, RTF, DOCX or native
+	Output    string // output folder
+	// File names: a merge template and the extension to add, see
+	// newOutputNamer
+	NamePattern string
+	Extension   string        // the template's own format if empty and it has one
+	Manifest    string        // results file; manifest.csv in Output if empty
+	Combined    bool          // one file, merged.<ext>, with a page per record
+	Email       *EmailOptions // .eml per record, or merged.mbox if Combined
+	SMTP        *SMTPOptions  // send Email messages instead of writing them
+	// Print onto sheets of labels, labels.pdf, or envelopes,
+	// envelopes.pdf, a record each. ReturnAddress goes on every envelope.
+	Labels        *LabelLayout
+	Envelope      *EnvelopeSize
+	ReturnAddress string
+}
+
+// Functions available to merge templates, beyond text/template's own
+var mergeFuncs = template.FuncMap{
+	"default":  mergeDefault,
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"title":    titleCase,
+	"trim":     strings.TrimSpace,
+	"split":    strings.Split,
+	"date":     formatDate,
+	"number":   formatNumber,
+	"currency": formatCurrency,
+	"sum":      sumField,
+	"count":    countRows,
+}
+
+// Words that start a text/template action rather than name a field
+var mergeKeywords = map[string]bool{
+	"if": true, "else": true, "end": true, "range": true, "with": true,
+	"define": true, "template": true, "block": true, "break": true,
+	"continue": true, "nil": true, "true": true, "false": true,
+	"and": true, "or": true, "not": true, "len": true, "index": true,
+	"slice": true, "print": true, "printf": true, "println": true,
+	"html": true, "js": true, "urlquery": true, "call": true,
+	"eq": true, "ne": true, "lt": true, "le": true, "gt": true, "ge": true,
+}
+
+// mergeAction reports whether the text between {{ and }} is template
+// syntax, like {{.Name}} or {{if .VIP}}, rather than a field written the
+// original way, like {{Name}} or {{First Name}}. A column name always
+// counts as a field, so check for one first.
+func mergeAction(field string) bool {
+	field = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(field, "-"), "-"))
+	if field == "" {
+		return false
+	}
+	if strings.ContainsRune(".$\"`('/", rune(field[0])) || unicode.IsDigit(rune(field[0])) {
+		return true
+	}
+	words := strings.FieldsFunc(field, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '|' || r == '('
+	})
+	if len(words) == 0 {
+		return true
+	}
+	_, isFunc := mergeFuncs[words[0]]
+	return isFunc || mergeKeywords[words[0]]
+}
+
+var (
+	mergeIndexRe  = regexp.MustCompile(`index\s+\.\s+"((?:[^"\\]|\\.)*)"`)
+	mergeStringRe = regexp.MustCompile("\"(?:[^\"\\\\]|\\\\.)*\"|`[^`]*`")
+	mergeDotRe    = regexp.MustCompile(`(?:^|[\s(|])\.([\pL_][\pL\pN_]*)`)
+)
+
+// templateFields lists the fields a template action refers to, as
+// .Field or index . "Field"
+func templateFields(action string) []string {
+	var fields []string
+	for _, m := range mergeIndexRe.FindAllStringSubmatch(action, -1) {
+		if name, err := strconv.Unquote(`"` + m[1] + `"`); err == nil {
+			fields = append(fields, name)
+		}
+	}
+	action = mergeStringRe.ReplaceAllString(action, `""`)
+	for _, m := range mergeDotRe.FindAllStringSubmatch(action, -1) {
+		fields = append(fields, m[1])
+	}
+	return fields
+}
+
+// parseMergeTemplate compiles a merge template. Fields written the
+// original way still work: {{Column}} becomes {{index . "Column"}}, so
+// names with spaces are fine, and any other {{Text}} is left as it was.
+func parseMergeTemplate(text string, columns []string) (*template.Template, error) {
+	known := map[string]bool{}
+	for _, col := range columns {
+		known[col] = true
+	}
+	text = mergeFieldRe.ReplaceAllStringFunc(text, func(field string) string {
+		name := field[2 : len(field)-2]
+		switch {
+		case known[name]:
+			return "{{index . " + strconv.Quote(name) + "}}"
+		case mergeAction(name):
+			return field
+		default:
+			return "{{" + strconv.Quote(field) + "}}"
+		}
+	})
+	return template.New("merge").Funcs(mergeFuncs).Option("missingkey=error").Parse(text)
+}
+
+// mergeRecord fills the template with one record. The merge and its
+// preview both go through here so they always agree.
+func mergeRecord(tmpl *template.Template, columns, values []string) (string, error) {
+	var out strings.Builder
+	if err := tmpl.Execute(&out, mergeData(columns, values)); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// {{default "Friend" .Name}} or {{.Name | default "Friend"}}
+func mergeDefault(def, value string) string {
+	if strings.TrimSpace(value) == "" {
+		return def
+	}
+	return value
+}
+
+// Capitalise the first letter of each word
+func titleCase(s string) string {
+	prev := ' '
+	return strings.Map(func(r rune) rune {
+		defer func() { prev = r }()
+		if unicode.IsSpace(prev) || prev == '-' || prev == '(' {
+			return unicode.ToTitle(r)
+		}
+		return r
+	}, s)
+}
+
+// Date layouts recognised in data, most common first
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"01/02/2006",
+	"2 Jan 2006",
+	"Jan 2, 2006",
+	"January 2, 2006",
+}
+
+// {{date "Jan 2, 2006" .Joined}} reformats a date using Go's reference
+// time as the layout. Empty values stay empty.
+func formatDate(layout, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	t, err := parseDate(value)
+	if err != nil {
+		return "", fmt.Errorf("date: %w", err)
+	}
+	return t.Format(layout), nil
+}
+
+// parseDate reads a date in any of dateLayouts, or as Unix seconds
+func parseDate(value string) (time.Time, error) {
+	for _, l := range dateLayouts {
+		if t, err := time.Parse(l, value); err == nil {
+			return t, nil
+		}
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("cannot read %q as a date", value)
+}
+
+// {{number 2 .Amount}} rounds to decimals places with thousands
+// separators: 1234.5 becomes 1,234.50
+func formatNumber(decimals int, value string) (string, error) {
+	value = strings.ReplaceAll(strings.TrimSpace(value), ",", "")
+	if value == "" {
+		return "", nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", fmt.Errorf("number: cannot read %q as a number", value)
+	}
+	s := strconv.FormatFloat(f, 'f', max(decimals, 0), 64)
+	sign := ""
+	if s[0] == '-' {
+		sign, s = "-", s[1:]
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	var b strings.Builder
+	b.WriteString(sign)
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(r)
+	}
+	if frac != "" {
+		b.WriteString("." + frac)
+	}
+	return b.String(), nil
+}
+
+// {{currency "$" .Amount}} gives $1,234.50, or -$1,234.50
+func formatCurrency(symbol, value string) (string, error) {
+	s, err := formatNumber(2, value)
+	if err != nil || s == "" {
+		return s, err
+	}
+	if strings.HasPrefix(s, "-") {
+		return "-" + symbol + s[1:], nil
+	}
+	return symbol + s, nil
+}
+
+// {{sum "Amount" .Items}} adds up a field of related rows or a JSON
+// list, keeping as many decimals as the most precise value. Blanks are
+// skipped.
+func sumField(field string, rows interface{}) (string, error) {
+	list, ok := rows.([]interface{})
+	if !ok {
+		return "", fmt.Errorf("sum: %s is not a list of rows", field)
+	}
+	total, decimals := 0.0, 0
+	for _, row := range list {
+		record, ok := row.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("sum: %s is not a list of rows", field)
+		}
+		value, ok := record[field].(string)
+		if !ok && record[field] != nil {
+			return "", fmt.Errorf("sum: %s is not a value", field)
+		}
+		value = strings.ReplaceAll(strings.TrimSpace(value), ",", "")
+		if value == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("sum: cannot read %q as a number", value)
+		}
+		if _, frac, ok := strings.Cut(value, "."); ok {
+			decimals = max(decimals, len(frac))
+		}
+		total += f
+	}
+	return strconv.FormatFloat(total, 'f', decimals, 64), nil
+}
+
+// {{count .Items}} is the number of related rows, or items in a list
+func countRows(rows interface{}) (int, error) {
+	list, ok := rows.([]interface{})
+	if !ok {
+		return 0, fmt.Errorf("count: not a list")
+	}
+	return len(list), nil
+}
+
+// Read the current row as n strings; NULL reads as empty
+func scanRecord(rows *sql.Rows, n int) ([]string, error) {
+	vals := make([]sql.NullString, n)
+	ptrs := make([]interface{}, n)
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+	record := make([]string, n)
+	for i, v := range vals {
+		record[i] = v.String
+	}
+	return record, nil
+}
+
+// The records of table that pass filter, with its column names and the
+// child rows of relations
+func loadRecords(db *sql.DB, table string, filter Filter, relations []Relation) ([]string, [][]string, error) {
+	extra, err := relationColumns(db, table, relations)
+	if err != nil {
+		return nil, nil, err
+	}
+	query, args, err := selectQuery(quoteIdent(table), filter, extra...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return readRecords(db, query, args...)
+}
+
+// Every row of query, as strings
+func readRecords(db *sql.DB, query string, args ...interface{}) ([]string, [][]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	var records [][]string
+	for rows.Next() {
+		record, err := scanRecord(rows, len(columns))
+		if err != nil {
+			return nil, nil, err
+		}
+		records = append(records, record)
+	}
+	return columns, records, rows.Err()
+}
+
+// MergeProgress counts records as a merge runs, for reading from
+// another goroutine
+type MergeProgress struct {
+	Done  atomic.Int64
+	Total atomic.Int64
+}
+
+// mergeSource opens the records job merges: the database they are in
+// and the SELECT, with its arguments, that reads them. That is db, or
+// the data file loaded into a database of its own. job.Table is set to
+// name the source. Call done once finished with the records.
+func mergeSource(db *sql.DB, job *MergeJob) (data *sql.DB, query string, args []interface{}, done func(), err error) {
+	if job.DataFile != "" && len(job.Relations) > 0 {
+		return nil, "", nil, nil, fmt.Errorf("related rows come from database tables, not a data file")
+	}
+	if job.Query != "" && (job.DataFile != "" || len(job.Relations) > 0) {
+		return nil, "", nil, nil, fmt.Errorf("a custom query is the whole source; it cannot take a data file or related rows")
+	}
+	data, done = db, func() {}
+	if job.DataFile != "" {
+		if data, job.Table, err = openDataFile(job.DataFile); err != nil {
+			return nil, "", nil, nil, err
+		}
+		done = func() { data.Close() }
+		defer func() {
+			if err != nil {
+				data.Close()
+			}
+		}()
+	}
+	from := quoteIdent(job.Table)
+	if job.Query != "" {
+		custom, err := checkQuery(job.Query)
+		if err != nil {
+			return nil, "", nil, nil, err
+		}
+		from, job.Table = queryFrom(custom), customQueryName
+	}
+	extra, err := relationColumns(data, job.Table, job.Relations)
+	if err != nil {
+		return nil, "", nil, nil, err
+	}
+	if query, args, err = selectQuery(from, job.Filter, extra...); err != nil {
+		return nil, "", nil, nil, fmt.Errorf("filter: %w", err)
+	}
+	return data, query, args, done, nil
+}
+
+// mailMerge writes one file per record of job's source and reports how
+// each went. The error is for problems that stop the merge starting.
+// Cancelling ctx stops it between records; files are written under a
+// temporary name and renamed, so none is left half written. progress
+// may be nil.
+func mailMerge(ctx context.Context, db *sql.DB, job MergeJob, progress *MergeProgress) (*MergeReport, error) {
+	if progress == nil {
+		progress = &MergeProgress{}
+	}
+	report := &MergeReport{Started: time.Now()}
+	printed := job.Labels != nil || job.Envelope != nil
+	if job.Labels != nil && job.Envelope != nil {
+		return nil, fmt.Errorf("print labels or envelopes, not both")
+	}
+	if printed && (job.Combined || job.Email != nil) {
+		return nil, fmt.Errorf("labels and envelopes are one PDF of every record; they cannot be combined or emailed")
+	}
+	combined := job.Combined || printed
+	source, err := loadMergeTemplate(job.Template)
+	if err != nil {
+		return nil, fmt.Errorf("reading template: %w", err)
+	}
+	// Query data
+	data, query, args, done, err := mergeSource(db, &job)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	var total int64
+	if err := data.QueryRowContext(ctx, "SELECT COUNT(*) FROM ("+query+")", args...).Scan(&total); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", job.Table, err)
+	}
+	progress.Total.Store(total)
+	report.Total = int(total)
+	var sender *Sender
+	if job.SMTP != nil {
+		if job.Email == nil || job.Combined {
+			return nil, fmt.Errorf("sending needs email messages, one per record")
+		}
+		if db == nil {
+			return nil, fmt.Errorf("sending needs a database for the delivery log")
+		}
+		if sender, err = newSender(db, *job.SMTP, deliveryJob(job)); err != nil {
+			return nil, err
+		}
+		defer sender.Close()
+	}
+	rows, err := data.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", job.Table, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", job.Table, err)
+	}
+
+	tmpl, err := newMergeTemplate(source, columns)
+	if err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	ext := job.Extension
+	if ext == "" {
+		ext = mergeOutputExt(job.Template)
+	}
+	var email *EmailTemplate
+	if job.Email != nil {
+		if email, err = newEmailTemplate(*job.Email, columns, filepath.Dir(job.Template)); err != nil {
+			return nil, err
+		}
+		ext = emailExtension
+	}
+	namer, err := newOutputNamer(job.NamePattern, ext, columns)
+	if err != nil {
+		return nil, err
+	}
+	manifest := job.Manifest
+	if manifest == "" {
+		manifest = filepath.Join(job.Output, defaultManifest)
+	}
+	if filepath.Dir(manifest) == filepath.Clean(job.Output) {
+		namer.Reserve(filepath.Base(manifest))
+	}
+
+	combinedPath := filepath.Join(job.Output, combinedName+namer.Ext())
+	switch {
+	case email != nil:
+		combinedPath = filepath.Join(job.Output, combinedName+mboxExtension)
+	case job.Labels != nil:
+		combinedPath = filepath.Join(job.Output, labelsName+".pdf")
+	case job.Envelope != nil:
+		combinedPath = filepath.Join(job.Output, envelopesName+".pdf")
+	}
+	// By record, for combined output
+	pages := map[int]*Document{}
+	messages := map[int][]byte{}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	add := func(result RecordResult) {
+		mu.Lock()
+		report.Results = append(report.Results, result)
+		mu.Unlock()
+		progress.Done.Add(1)
+	}
+	next := func() ([]string, error) {
+		return scanRecord(rows, len(columns))
+	}
+	more := rows.Next
+	if sender != nil {
+		// The delivery log is written as messages go, which the open query
+		// would block, so a send reads its records first
+		var records [][]string
+		var errs []error
+		for rows.Next() {
+			vals, err := scanRecord(rows, len(columns))
+			records, errs = append(records, vals), append(errs, err)
+		}
+		if err := rows.Close(); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", job.Table, err)
+		}
+		next = func() ([]string, error) {
+			vals, err := records[0], errs[0]
+			records, errs = records[1:], errs[1:]
+			return vals, err
+		}
+		more = func() bool { return len(records) > 0 }
+	}
+	semaphore := make(chan struct{}, 50) // Limit goroutines for Win98
+	for n := 1; ctx.Err() == nil && more(); n++ {
+		result := RecordResult{Record: n, Key: strconv.Itoa(n)}
+		vals, err := next()
+		if err != nil {
+			add(result.Failed(err))
+			continue
+		}
+		result.Key = recordKey(columns, vals, n)
+		if combined {
+			result.Output = combinedPath
+		} else {
+			// Named here, in order, so duplicates get the same suffixes every run
+			name, err := namer.Name(columns, vals)
+			if err != nil {
+				add(result.Failed(err))
+				continue
+			}
+			result.Output = filepath.Join(job.Output, name)
+		}
+		select {
+		case semaphore <- struct{}{}: // Acquire
+		case <-ctx.Done():
+			add(result.Cancelled())
+			continue
+		}
+		wg.Add(1)
+		go func(vals []string, result RecordResult) {
+			defer wg.Done()
+			defer func() { <-semaphore }() // Release
+			if ctx.Err() != nil {
+				add(result.Cancelled())
+				return
+			}
+			doc, err := tmpl.Merge(columns, vals)
+			var data []byte
+			var env Envelope
+			switch {
+			case err != nil:
+			case email != nil:
+				data, env, err = email.Message(columns, vals, doc)
+			case !combined:
+				data, err = renderDocument(namer.Ext(), doc)
+			}
+			if err == nil && sender != nil {
+				result.Output = "mailto:" + strings.Join(env.To, ",")
+				if when, sent := sender.Sent(result.Key, env.To); sent {
+					add(result.Skipped(when))
+					return
+				}
+				err = sender.Deliver(ctx, result.Key, env, data)
+			} else if err == nil && combined {
+				// Written together once every record is in
+				mu.Lock()
+				pages[result.Record], messages[result.Record] = doc, data
+				mu.Unlock()
+			} else if err == nil {
+				err = writeOutput(ctx, result.Output, data)
+			}
+			if ctx.Err() != nil && err != nil {
+				add(result.Cancelled())
+				return
+			}
+			if err != nil {
+				add(result.Failed(err))
+				return
+			}
+			result.Status = statusOK
+			add(result)
+		}(vals, result)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		report.Cancelled = true
+	} else if err := rows.Err(); err != nil {
+		report.Err = err.Error()
+	}
+	report.Finish()
+	if job.Combined && email != nil {
+		writeCombined(ctx, report, combinedPath, func(records []int) ([]byte, error) {
+			list := make([][]byte, len(records))
+			for i, n := range records {
+				list[i] = messages[n]
+			}
+			return mbox(list), nil
+		})
+	} else if combined {
+		writeCombined(ctx, report, combinedPath, func(records []int) ([]byte, error) {
+			docs := make([]*Document, len(records))
+			for i, n := range records {
+				docs[i] = pages[n]
+			}
+			switch {
+			case job.Labels != nil:
+				return labelsPDF(*job.Labels, docs), nil
+			case job.Envelope != nil:
+				return envelopesPDF(*job.Envelope, job.ReturnAddress, docs), nil
+			}
+			return renderDocument(namer.Ext(), combineDocuments(docs))
+		})
+	}
+	if err := report.WriteManifest(manifest); err != nil {
+		return report, fmt.Errorf("writing manifest: %w", err)
+	}
+	report.Manifest = manifest
+	return report, nil
+}
+
+// Write the merged records of a combined merge to path, as render
+// gives them for the records that merged, in order. Nothing is written
+// if the merge was cancelled, and records count as merged only once the
+// file is written.
+func writeCombined(ctx context.Context, report *MergeReport, path string, render func(records []int) ([]byte, error)) {
+	var records []int
+	for _, result := range report.Results {
+		if result.Status == statusOK {
+			records = append(records, result.Record)
+		}
+	}
+	var err error
+	if len(records) > 0 && ctx.Err() == nil {
+		var data []byte
+		if data, err = render(records); err == nil {
+			err = writeOutput(ctx, path, data)
+		}
+	}
+	for i, result := range report.Results {
+		if result.Status != statusOK {
+			continue
+		}
+		if ctx.Err() != nil {
+			report.Results[i] = result.Cancelled()
+		} else if err != nil {
+			report.Results[i] = result.Failed(err)
+		}
+	}
+}
+
+// Merged output in the format ext names; anything else is plain UTF-8
+// text
+func renderDocument(ext string, doc *Document) ([]byte, error) {
+	switch strings.ToLower(ext) {
+	case ".rtf":
+		return []byte(documentRTF(doc)), nil
+	case ".pdf":
+		p := &PDF{Info: doc.Props}
+		layoutDocument(p, doc)
+		return p.Bytes(), nil
+	case ".docx":
+		return zipBytes(docxPackage(doc))
+	case ".odt":
+		return zipBytes(odtPackage(doc))
+	case ".html", ".htm":
+		return []byte(documentHTML(doc)), nil
+	case nativeExt:
+		return json.MarshalIndent(doc, "", "  ")
+	}
+	// Plain text pages are separated by a bare form feed
+	return []byte(strings.ReplaceAll(doc.Text, "\n"+pageBreak+"\n", pageBreak)), nil
+}
+
+// Write data to a temporary file beside path and rename it into place,
+// unless ctx is cancelled first
+func writeOutput(ctx context.Context, path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
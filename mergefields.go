@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/gotk3/gotk3/gdk"
+	"github.com/gotk3/gotk3/glib"
+	"github.com/gotk3/gotk3/gtk"
+	"github.com/gotk3/gotk3/pango"
+)
+
+// A merge field as written in templates
+var mergeFieldRe = regexp.MustCompile(`\{\{([^{}]*)\}\}`)
+
+// MergeFields highlights the {{fields}} of a mail merge template in the
+// editor. Fields naming a column of the merge table become chips that
+// cannot be edited, only deleted whole. Template actions such as
+// {{if .VIP}} are shaded but stay editable. Anything referring to a
+// column the table lacks is flagged.
+type MergeFields struct {
+	ed      *Editor
+	db      *sql.DB
+	Table   string
+	Query   string // a custom query merged instead of Table, if set
+	columns map[string]bool
+	chip    *gtk.TextTag
+	action  *gtk.TextTag
+	unknown *gtk.TextTag
+	pending bool
+}
+
+func newMergeFields(ed *Editor, db *sql.DB) *MergeFields {
+	m := &MergeFields{ed: ed, db: db, Table: "contacts"}
+	var err error
+	m.chip, err = gtk.TextTagNew("merge-field")
+	if err != nil {
+		log.Fatal("Unable to create tag:", err)
+	}
+	m.chip.SetProperty("background", "#CCE5FF")
+	m.chip.SetProperty("editable", false)
+	ed.tagTable.Add(m.chip)
+	m.action, err = gtk.TextTagNew("merge-action")
+	if err != nil {
+		log.Fatal("Unable to create tag:", err)
+	}
+	m.action.SetProperty("background", "#EEE6FF")
+	m.action.SetProperty("foreground", "#5B2C8F")
+	ed.tagTable.Add(m.action)
+	m.unknown, err = gtk.TextTagNew("merge-field-unknown")
+	if err != nil {
+		log.Fatal("Unable to create tag:", err)
+	}
+	m.unknown.SetProperty("foreground", "#CC0000")
+	m.unknown.SetProperty("underline", pango.UNDERLINE_ERROR)
+	ed.tagTable.Add(m.unknown)
+
+	m.SetTable(m.Table)
+	ed.buffer.Connect("changed", func() {
+		if m.pending {
+			return
+		}
+		m.pending = true
+		glib.IdleAdd(func() bool {
+			m.pending = false
+			m.Validate()
+			return false
+		})
+	})
+	ed.textView.Connect("key-press-event", m.keyPress)
+	return m
+}
+
+// SetTable makes table the source of valid field names
+func (m *MergeFields) SetTable(table string) {
+	m.Table, m.Query = table, ""
+	m.refresh()
+}
+
+// SetQuery makes the result columns of a custom query the valid field
+// names
+func (m *MergeFields) SetQuery(query string) {
+	m.Table, m.Query = customQueryName, query
+	m.refresh()
+}
+
+func (m *MergeFields) refresh() {
+	m.columns = map[string]bool{}
+	for _, name := range m.names() {
+		m.columns[name] = true
+	}
+	m.Validate()
+}
+
+// The columns of the merge table or query, in order
+func (m *MergeFields) names() []string {
+	if m.Query != "" {
+		names, err := queryColumns(m.db, m.Query)
+		if err != nil {
+			log.Println("Query error:", err)
+		}
+		return names
+	}
+	columns, err := tableColumns(m.db, m.Table)
+	if err != nil {
+		log.Println("Table info error:", err)
+	}
+	return colNames(columns)
+}
+
+// Validate re-tags every field in the buffer against the merge table.
+// Large read-only files are left alone.
+func (m *MergeFields) Validate() {
+	buffer := m.ed.buffer
+	start, end := buffer.GetBounds()
+	buffer.RemoveTag(m.chip, start, end)
+	buffer.RemoveTag(m.action, start, end)
+	buffer.RemoveTag(m.unknown, start, end)
+	if m.ed.readOnly || m.ed.loading {
+		return
+	}
+	text, err := buffer.GetText(start, end, true)
+	if err != nil {
+		log.Println("Get text error:", err)
+		return
+	}
+	for _, f := range findMergeFields(text) {
+		tag := m.action
+		if m.columns[f.Name] {
+			tag = m.chip
+		} else if len(m.missing(f)) > 0 {
+			tag = m.unknown
+		}
+		buffer.ApplyTag(tag, buffer.GetIterAtOffset(f.Start), buffer.GetIterAtOffset(f.End))
+	}
+}
+
+// Unknown returns the fields used in the buffer that are not columns of
+// the merge table
+func (m *MergeFields) Unknown() []string {
+	start, end := m.ed.buffer.GetBounds()
+	text, _ := m.ed.buffer.GetText(start, end, true)
+	var unknown []string
+	seen := map[string]bool{}
+	for _, f := range findMergeFields(text) {
+		for _, name := range m.missing(f) {
+			if !seen[name] {
+				seen[name] = true
+				unknown = append(unknown, name)
+			}
+		}
+	}
+	return unknown
+}
+
+// The names f refers to that are not columns of the merge table
+func (m *MergeFields) missing(f mergeField) []string {
+	if m.columns[f.Name] {
+		return nil
+	}
+	if !mergeAction(f.Name) {
+		return []string{f.Name}
+	}
+	var missing []string
+	for _, name := range templateFields(f.Name) {
+		if !m.columns[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// Insert column as a field at the cursor, replacing the selection
+func (m *MergeFields) Insert(column string) {
+	buffer := m.ed.buffer
+	buffer.DeleteSelection(true, true)
+	buffer.InsertAtCursor("{{" + column + "}}")
+	m.Validate()
+}
+
+// Chips cannot be edited, so Backspace and Delete next to one remove it
+// whole, and a selection is deleted chips and all.
+func (m *MergeFields) keyPress(tv *gtk.TextView, ev *gdk.Event) bool {
+	key := gdk.EventKeyNewFromEvent(ev).KeyVal()
+	if (key != gdk.KEY_BackSpace && key != gdk.KEY_Delete) || !tv.GetEditable() {
+		return false
+	}
+	buffer := m.ed.buffer
+	if start, end, ok := buffer.GetSelectionBounds(); ok {
+		buffer.Delete(start, end)
+		return true
+	}
+	cursor := buffer.GetIterAtMark(buffer.GetInsert())
+	offset := cursor.GetOffset()
+	if key == gdk.KEY_BackSpace {
+		if offset == 0 || !buffer.GetIterAtOffset(offset-1).HasTag(m.chip) {
+			return false
+		}
+		lineStart := buffer.GetIterAtLine(cursor.GetLine())
+		text, _ := buffer.GetText(lineStart, cursor, true)
+		for _, f := range findMergeFields(text) {
+			if lineStart.GetOffset()+f.End == offset {
+				buffer.Delete(buffer.GetIterAtOffset(lineStart.GetOffset()+f.Start), cursor)
+				return true
+			}
+		}
+		return false
+	}
+	if !cursor.HasTag(m.chip) {
+		return false
+	}
+	lineEnd := buffer.GetIterAtOffset(offset)
+	lineEnd.ForwardToLineEnd()
+	text, _ := buffer.GetText(cursor, lineEnd, true)
+	if fields := findMergeFields(text); len(fields) > 0 && fields[0].Start == 0 {
+		buffer.Delete(cursor, buffer.GetIterAtOffset(offset+fields[0].End))
+		return true
+	}
+	return false
+}
+
+// Build the Insert Merge Field menu: the merge table's columns, then a
+// submenu to pick the table
+func (m *MergeFields) Menu() *gtk.Menu {
+	menu, err := gtk.MenuNew()
+	if err != nil {
+		log.Fatal("Unable to create menu:", err)
+	}
+	columns := m.names()
+	for _, name := range columns {
+		name := name
+		item, err := gtk.MenuItemNewWithLabel(name)
+		if err != nil {
+			log.Fatal("Unable to create menu item:", err)
+		}
+		item.Connect("activate", func() {
+			m.Insert(name)
+		})
+		menu.Append(item)
+	}
+	if len(columns) == 0 {
+		item, err := gtk.MenuItemNewWithLabel("No columns in " + m.Table)
+		if err != nil {
+			log.Fatal("Unable to create menu item:", err)
+		}
+		item.SetSensitive(false)
+		menu.Append(item)
+	}
+	sep, err := gtk.SeparatorMenuItemNew()
+	if err != nil {
+		log.Fatal("Unable to create separator:", err)
+	}
+	menu.Append(sep)
+
+	sources, err := dataSources(m.db)
+	if err != nil {
+		log.Println("Table list error:", err)
+	}
+	tableMenu, err := gtk.MenuNew()
+	if err != nil {
+		log.Fatal("Unable to create menu:", err)
+	}
+	for _, source := range sources {
+		table := source.Name
+		item, err := gtk.CheckMenuItemNewWithLabel(source.Label())
+		if err != nil {
+			log.Fatal("Unable to create menu item:", err)
+		}
+		item.SetDrawAsRadio(true)
+		item.SetActive(table == m.Table)
+		item.Connect("activate", func() {
+			m.SetTable(table)
+		})
+		tableMenu.Append(item)
+	}
+	title := "Table: " + m.Table
+	if m.Query != "" {
+		title = "Table: (custom query)"
+	}
+	tableItem, err := gtk.MenuItemNewWithLabel(title)
+	if err != nil {
+		log.Fatal("Unable to create menu item:", err)
+	}
+	tableItem.SetSubmenu(tableMenu)
+	tableItem.SetSensitive(len(sources) > 0)
+	menu.Append(tableItem)
+	menu.ShowAll()
+	return menu
+}
+
+// A field found in template text, with rune offsets
+type mergeField struct {
+	Name       string
+	Start, End int
+}
+
+func findMergeFields(text string) []mergeField {
+	var fields []mergeField
+	offset, last := 0, 0 // rune offset of byte offset last
+	for _, loc := range mergeFieldRe.FindAllStringSubmatchIndex(text, -1) {
+		offset += utf8.RuneCountInString(text[last:loc[0]])
+		last = loc[0]
+		fields = append(fields, mergeField{
+			Name:  text[loc[2]:loc[3]],
+			Start: offset,
+			End:   offset + utf8.RuneCountInString(text[loc[0]:loc[1]]),
+		})
+	}
+	return fields
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// Formatting travels through text/template as private use characters,
+// one opening and one closing each tag span of the template
+const (
+	markerOpen  = 0xF0000  // Supplementary Private Use Area-A
+	markerClose = 0x100000 // Supplementary Private Use Area-B
+	maxMarkers  = 0xFFFE
+)
+
+// MergeTemplate is a merge template with formatting, read from plain
+// text, RTF, DOCX or a native document. Fields are filled in as in a
+// plain template; bold, italic, sizes, alignment and links around them
+// carry through to the merged document.
+type MergeTemplate struct {
+	tmpl  *template.Template
+	tags  []TagSpan
+	props Properties
+}
+
+// Read a template file, choosing the format by extension. Anything not
+// RTF, DOCX or native is plain text.
+func loadMergeTemplate(filename string) (*Document, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == nativeExt {
+		return loadDocument(filename)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	switch ext {
+	case ".rtf":
+		return parseRTF(string(data)), nil
+	case ".docx":
+		return parseDOCX(data)
+	}
+	return &Document{Text: string(data)}, nil
+}
+
+// The output format a template's merges get unless told otherwise: its
+// own for formatted templates, or "" for the namer's default
+func mergeOutputExt(template string) string {
+	switch ext := strings.ToLower(filepath.Ext(template)); ext {
+	case nativeExt, ".rtf", ".docx":
+		return ext
+	}
+	return ""
+}
+
+// newMergeTemplate compiles doc as a merge template for columns. A tag
+// that starts or ends inside a {{...}} action is widened to the whole
+// action, so a field takes the formatting of any part of it. Pending
+// deletions are left out and review state is dropped.
+func newMergeTemplate(doc *Document, columns []string) (*MergeTemplate, error) {
+	src := doc.Slice(0, utf8.RuneCountInString(doc.Text))
+	if len(src.Tags) > maxMarkers {
+		return nil, fmt.Errorf("too much formatting: %d spans, at most %d", len(src.Tags), maxMarkers)
+	}
+	runes := []rune(src.Text)
+
+	// Actions as rune offsets
+	var actions [][2]int
+	for _, loc := range mergeFieldRe.FindAllStringIndex(src.Text, -1) {
+		start := utf8.RuneCountInString(src.Text[:loc[0]])
+		actions = append(actions, [2]int{start, start + utf8.RuneCountInString(src.Text[loc[0]:loc[1]])})
+	}
+	widen := func(off int, end bool) int {
+		for _, a := range actions {
+			if a[0] < off && off < a[1] {
+				if end {
+					return a[1]
+				}
+				return a[0]
+			}
+		}
+		return off
+	}
+	// Closing markers go first so spans that meet stay apart
+	markers := make([][]rune, len(runes)+1)
+	for i, t := range src.Tags {
+		end := widen(t.End, true)
+		markers[end] = append(markers[end], rune(markerClose+i))
+	}
+	for i, t := range src.Tags {
+		start := widen(t.Start, false)
+		markers[start] = append(markers[start], rune(markerOpen+i))
+	}
+	var b strings.Builder
+	for i := 0; i <= len(runes); i++ {
+		for _, m := range markers[i] {
+			b.WriteRune(m)
+		}
+		if i < len(runes) {
+			b.WriteRune(runes[i])
+		}
+	}
+
+	tmpl, err := parseMergeTemplate(b.String(), columns)
+	if err != nil {
+		return nil, err
+	}
+	return &MergeTemplate{tmpl: tmpl, tags: src.Tags, props: doc.Props}, nil
+}
+
+// Merge fills the template with one record. Formatting in a part of the
+// template that {{if}} leaves out goes with it, and {{range}} repeats it.
+func (t *MergeTemplate) Merge(columns, values []string) (*Document, error) {
+	text, err := mergeRecord(t.tmpl, columns, values)
+	if err != nil {
+		return nil, err
+	}
+	doc := &Document{Props: t.props}
+	var out []rune
+	open := map[int]int{} // tag -> where its latest copy starts
+	for _, r := range text {
+		switch {
+		case r >= markerOpen && r < markerOpen+rune(len(t.tags)):
+			open[int(r-markerOpen)] = len(out)
+		case r >= markerClose && r < markerClose+rune(len(t.tags)):
+			i := int(r - markerClose)
+			start, ok := open[i]
+			delete(open, i)
+			if ok && start < len(out) {
+				span := t.tags[i]
+				span.Start, span.End = start, len(out)
+				doc.Tags = append(doc.Tags, span)
+			}
+		default:
+			out = append(out, r)
+		}
+	}
+	doc.Text = string(out)
+	sort.SliceStable(doc.Tags, func(i, j int) bool { return doc.Tags[i].Start < doc.Tags[j].Start })
+	return doc, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Output names when no pattern is given: the original resume_<name> for
+// tables with a Name column, numbered records otherwise
+const (
+	namedPattern     = "resume_{{.Name | lower}}"
+	unnamedPattern   = "record"
+	combinedName     = "merged"
+	labelsName       = "labels"
+	envelopesName    = "envelopes"
+	defaultExtension = "txt"
+)
+
+// A pattern ending in an extension of its own, like {{.ID}}.pdf
+var patternExtRe = regexp.MustCompile(`\.[A-Za-z0-9]{1,8}$`)
+
+// Names that Windows reserves for devices, whatever the extension
+var reservedNames = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[1-9]|lpt[1-9])$`)
+
+// OutputNamer turns records into safe output file names that are unique
+// within one merge
+type OutputNamer struct {
+	pattern string // without the extension
+	tmpl    *template.Template
+	ext     string
+	used    map[string]bool
+}
+
+// newOutputNamer compiles a file name pattern, a merge template such as
+// {{.LastName}}_{{.ID}}. An empty pattern picks one to suit columns. The
+// extension is used unless the pattern ends with one.
+func newOutputNamer(pattern, ext string, columns []string) (*OutputNamer, error) {
+	if strings.TrimSpace(pattern) == "" {
+		pattern = unnamedPattern
+		for _, col := range columns {
+			if col == "Name" {
+				pattern = namedPattern
+			}
+		}
+	}
+	// Only text after the last action can be an extension
+	tail := pattern
+	if i := strings.LastIndex(pattern, "}}"); i >= 0 {
+		tail = pattern[i+len("}}"):]
+	}
+	if m := patternExtRe.FindString(tail); m != "" {
+		pattern, ext = strings.TrimSuffix(pattern, m), m
+	}
+	ext = strings.Trim(strings.TrimSpace(ext), ".")
+	if ext == "" {
+		ext = defaultExtension
+	}
+	tmpl, err := parseMergeTemplate(pattern, columns)
+	if err != nil {
+		return nil, fmt.Errorf("file name pattern: %w", err)
+	}
+	return &OutputNamer{pattern: pattern, tmpl: tmpl, ext: "." + sanitizeFilename(ext), used: map[string]bool{}}, nil
+}
+
+// Name for the next record. Repeats get _2, _3 and so on. Not safe for
+// concurrent use; name records before handing them to workers.
+func (n *OutputNamer) Name(columns, values []string) (string, error) {
+	name, err := n.Wanted(columns, values)
+	if err != nil {
+		return "", err
+	}
+	base := strings.TrimSuffix(name, n.ext)
+	for i := 2; n.used[strings.ToLower(name)]; i++ {
+		name = fmt.Sprintf("%s_%d%s", base, i, n.ext)
+	}
+	// Case-insensitive file systems would still collide
+	n.used[strings.ToLower(name)] = true
+	return name, nil
+}
+
+// Wanted is the name a record would get were it the first to have it
+func (n *OutputNamer) Wanted(columns, values []string) (string, error) {
+	base, err := mergeRecord(n.tmpl, columns, values)
+	if err != nil {
+		return "", fmt.Errorf("file name pattern: %w", err)
+	}
+	return sanitizeFilename(base) + n.ext, nil
+}
+
+// Ext is the extension given to every name, with its dot
+func (n *OutputNamer) Ext() string {
+	return n.ext
+}
+
+// Reserve keeps name from being given to a record
+func (n *OutputNamer) Reserve(name string) {
+	n.used[strings.ToLower(name)] = true
+}
+
+// sanitizeFilename makes name safe to use as a file name on any system:
+// separators, reserved characters and whitespace become underscores,
+// leading and trailing dots go, and device names are avoided
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || unicode.IsSpace(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, "._")
+	if reservedNames.MatchString(name) {
+		name = "_" + name
+	}
+	// Leave room for a suffix and extension within common 255 byte limits
+	for len(name) > 200 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" {
+		return unnamedPattern
+	}
+	return name
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const odtNS = `xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" ` +
+	`xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0" ` +
+	`xmlns:style="urn:oasis:names:tc:opendocument:xmlns:style:1.0" ` +
+	`xmlns:fo="urn:oasis:names:tc:opendocument:xmlns:xsl-fo-compatible:1.0" ` +
+	`xmlns:dc="http://purl.org/dc/elements/1.1/" ` +
+	`xmlns:loext="urn:org:documentfoundation:names:experimental:office:xmlns:loext:1.0"`
+
+const odtManifest = `<?xml version="1.0" encoding="UTF-8"?>
+<manifest:manifest xmlns:manifest="urn:oasis:names:tc:opendocument:xmlns:manifest:1.0" manifest:version="1.2">
+<manifest:file-entry manifest:full-path="/" manifest:media-type="application/vnd.oasis.opendocument.text"/>
+<manifest:file-entry manifest:full-path="content.xml" manifest:media-type="text/xml"/>
+<manifest:file-entry manifest:full-path="meta.xml" manifest:media-type="text/xml"/>
+</manifest:manifest>`
+
+// Write document as an OpenDocument text package. Pending deletions are
+// left out, comments become annotations.
+func saveODT(filename string, doc *Document) error {
+	return writeZip(filename, odtPackage(doc))
+}
+
+func odtPackage(doc *Document) []zipPart {
+	return []zipPart{
+		{name: "mimetype", body: "application/vnd.oasis.opendocument.text"},
+		{name: "META-INF/manifest.xml", body: odtManifest},
+		{name: "content.xml", body: odtContent(doc)},
+		{name: "meta.xml", body: odtMeta(doc.Props)},
+	}
+}
+
+func odtContent(doc *Document) string {
+	paras := doc.Paragraphs()
+
+	// One automatic text style per combination of run formatting
+	textStyles := map[string]string{}
+	var styleKeys []string
+	for _, p := range paras {
+		for _, r := range p.Runs {
+			if key := odtTextProps(r); key != "" && textStyles[key] == "" {
+				textStyles[key] = fmt.Sprintf("T%d", len(textStyles)+1)
+				styleKeys = append(styleKeys, key)
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<office:document-content ` + odtNS + ` office:version="1.2">`)
+	b.WriteString(`<office:automatic-styles>`)
+	b.WriteString(`<style:style style:name="P1" style:family="paragraph"><style:paragraph-properties fo:text-align="center"/></style:style>`)
+	b.WriteString(`<style:style style:name="PB" style:family="paragraph"><style:paragraph-properties fo:break-after="page"/></style:style>`)
+	for _, key := range styleKeys {
+		fmt.Fprintf(&b, `<style:style style:name="%s" style:family="text"><style:text-properties %s/></style:style>`,
+			textStyles[key], key)
+	}
+	b.WriteString(`</office:automatic-styles><office:body><office:text>`)
+
+	started := make([]bool, len(doc.Comments))
+	ended := make([]bool, len(doc.Comments))
+	for _, p := range paras {
+		if p.PageBreak() {
+			b.WriteString(`<text:p text:style-name="PB"/>`)
+			continue
+		}
+		if p.Align() == "center" {
+			b.WriteString(`<text:p text:style-name="P1">`)
+		} else {
+			b.WriteString(`<text:p>`)
+		}
+		for _, r := range p.Runs {
+			for i, c := range doc.Comments {
+				if !started[i] && c.Start <= r.Start {
+					started[i] = true
+					b.WriteString(odtAnnotation(c))
+				}
+			}
+			if r.Change == nil || r.Change.Kind != ChangeDelete {
+				if style := textStyles[odtTextProps(r)]; style != "" {
+					fmt.Fprintf(&b, `<text:span text:style-name="%s">%s</text:span>`, style, odtText(r.Text))
+				} else {
+					b.WriteString(odtText(r.Text))
+				}
+			}
+			for i, c := range doc.Comments {
+				if started[i] && !ended[i] && c.End <= r.End && c.End > c.Start {
+					ended[i] = true
+					fmt.Fprintf(&b, `<office:annotation-end office:name="c%d"/>`, c.ID)
+				}
+			}
+		}
+		b.WriteString(`</text:p>`)
+	}
+	b.WriteString(`</office:text></office:body></office:document-content>`)
+	return b.String()
+}
+
+func odtMeta(props Properties) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<office:document-meta xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" ` +
+		`xmlns:meta="urn:oasis:names:tc:opendocument:xmlns:meta:1.0" xmlns:dc="http://purl.org/dc/elements/1.1/" ` +
+		`office:version="1.2"><office:meta><meta:generator>GoATPAD</meta:generator>`)
+	for _, field := range []struct{ elem, value string }{
+		{"dc:title", props.Title},
+		{"dc:subject", props.Subject},
+		{"meta:initial-creator", props.Author},
+		{"dc:creator", props.Author},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(&b, "<%s>%s</%s>", field.elem, xmlEscape(field.value), field.elem)
+		}
+	}
+	for _, k := range props.KeywordList() {
+		fmt.Fprintf(&b, "<meta:keyword>%s</meta:keyword>", xmlEscape(k))
+	}
+	b.WriteString(`</office:meta></office:document-meta>`)
+	return b.String()
+}
+
+func odtTextProps(r Run) string {
+	var props []string
+	if _, ok := r.Tags["bold"]; ok {
+		props = append(props, `fo:font-weight="bold"`)
+	}
+	if _, ok := r.Tags["italic"]; ok {
+		props = append(props, `fo:font-style="italic"`)
+	}
+	if size, ok := r.Tags["size"]; ok && size != "" {
+		props = append(props, fmt.Sprintf(`fo:font-size="%spt"`, size))
+	}
+	return strings.Join(props, " ")
+}
+
+// Annotation for a comment thread; replies follow the comment text
+func odtAnnotation(c Comment) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<office:annotation office:name="c%d"`, c.ID)
+	if c.Resolved {
+		b.WriteString(` loext:resolved="true"`)
+	}
+	fmt.Fprintf(&b, `><dc:creator>%s</dc:creator><dc:date>%s</dc:date>`,
+		xmlEscape(c.Author), c.Time.Format(time.RFC3339))
+	for _, line := range strings.Split(c.Text, "\n") {
+		fmt.Fprintf(&b, `<text:p>%s</text:p>`, odtText(line))
+	}
+	for _, r := range c.Replies {
+		fmt.Fprintf(&b, `<text:p>%s (%s): %s</text:p>`,
+			xmlEscape(r.Author), r.Time.Format("2006-01-02 15:04"), odtText(r.Text))
+	}
+	b.WriteString(`</office:annotation>`)
+	return b.String()
+}
+
+// ODF collapses whitespace, so runs of spaces and tabs need elements
+func odtText(s string) string {
+	var b strings.Builder
+	spaces := 0
+	flush := func() {
+		if spaces > 0 {
+			fmt.Fprintf(&b, `<text:s text:c="%d"/>`, spaces)
+			spaces = 0
+		}
+	}
+	prevSpace := false
+	for _, r := range s {
+		switch {
+		case r == ' ' && prevSpace:
+			spaces++
+			continue
+		case r == '\t':
+			flush()
+			b.WriteString(`<text:tab/>`)
+			prevSpace = false
+			continue
+		}
+		flush()
+		prevSpace = r == ' '
+		b.WriteString(xmlEscape(string(r)))
+	}
+	flush()
+	return b.String()
+}
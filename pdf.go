@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Minimal PDF writer using the standard Helvetica fonts, so no font files
+// need to be embedded. Text is encoded as WinAnsi (Windows-1252).
+
+// US Letter in points
+const (
+	pdfPageWidth  = 612.0
+	pdfPageHeight = 792.0
+	pdfMargin     = 72.0
+)
+
+// Fonts by resource name
+var pdfFonts = []struct{ name, base string }{
+	{"F1", "Helvetica"},
+	{"F2", "Helvetica-Bold"},
+	{"F3", "Helvetica-Oblique"},
+	{"F4", "Helvetica-BoldOblique"},
+}
+
+// Glyph widths (1/1000 em) for characters 32-126
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+var helveticaBoldWidths = [95]int{
+	278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+	975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+	333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+	611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+}
+
+// Width of s in points
+func pdfTextWidth(s, font string, size float64) float64 {
+	widths := &helveticaWidths
+	if font == "F2" || font == "F4" {
+		widths = &helveticaBoldWidths
+	}
+	total := 0
+	for _, r := range s {
+		if r >= 32 && r <= 126 {
+			total += widths[r-32]
+		} else {
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+type PDF struct {
+	Info Properties
+	// Page size in points; US Letter if zero
+	Width, Height float64
+	pages         []*bytes.Buffer
+	annots        [][]string // link annotations per page
+}
+
+// AddPage starts a new page; drawing calls go to the last page
+func (p *PDF) AddPage() {
+	p.pages = append(p.pages, &bytes.Buffer{})
+	p.annots = append(p.annots, nil)
+}
+
+// Text draws s with its baseline starting at x, y (from the bottom left)
+func (p *PDF) Text(x, y float64, font string, size float64, s string) {
+	if len(p.pages) == 0 {
+		p.AddPage()
+	}
+	fmt.Fprintf(p.pages[len(p.pages)-1], "BT /%s %s Tf %s %s Td (%s) Tj ET\n",
+		font, pdfNum(size), pdfNum(x), pdfNum(y), pdfEscape(s))
+}
+
+// Clip confines drawing on the last page to the rectangle x1, y1 - x2, y2
+// until Unclip
+func (p *PDF) Clip(x1, y1, x2, y2 float64) {
+	if len(p.pages) == 0 {
+		p.AddPage()
+	}
+	fmt.Fprintf(p.pages[len(p.pages)-1], "q %s %s %s %s re W n\n",
+		pdfNum(x1), pdfNum(y1), pdfNum(x2-x1), pdfNum(y2-y1))
+}
+
+// Unclip ends the last Clip
+func (p *PDF) Unclip() {
+	p.pages[len(p.pages)-1].WriteString("Q\n")
+}
+
+// Link makes the rectangle x1, y1 - x2, y2 on the last page open url
+func (p *PDF) Link(x1, y1, x2, y2 float64, url string) {
+	if len(p.pages) == 0 {
+		p.AddPage()
+	}
+	last := len(p.pages) - 1
+	p.annots[last] = append(p.annots[last], fmt.Sprintf(
+		"<< /Type /Annot /Subtype /Link /Rect [%s %s %s %s] /Border [0 0 0] /A << /S /URI /URI (%s) >> >>",
+		pdfNum(x1), pdfNum(y1), pdfNum(x2), pdfNum(y2), pdfEscape(url)))
+}
+
+// Bytes renders the finished file
+func (p *PDF) Bytes() []byte {
+	if len(p.pages) == 0 {
+		p.AddPage()
+	}
+	var out bytes.Buffer
+	var offsets []int
+	obj := func(body string) int {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+		return len(offsets)
+	}
+	out.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+	width, height := p.Width, p.Height
+	if width <= 0 || height <= 0 {
+		width, height = pdfPageWidth, pdfPageHeight
+	}
+
+	// Object numbers are fixed up front: catalog, page tree, fonts, then
+	// a page and a content stream per page, then the info dictionary.
+	catalog := 1
+	pagesObj := 2
+	firstFont := 3
+	firstPage := firstFont + len(pdfFonts)
+
+	obj(fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pagesObj))
+	var kids []string
+	for i := range p.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", firstPage+2*i))
+	}
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)))
+	var fontRes []string
+	for i, f := range pdfFonts {
+		obj(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", f.base))
+		fontRes = append(fontRes, fmt.Sprintf("/%s %d 0 R", f.name, firstFont+i))
+	}
+	for i, content := range p.pages {
+		annots := ""
+		if len(p.annots[i]) > 0 {
+			annots = " /Annots [" + strings.Join(p.annots[i], " ") + "]"
+		}
+		obj(fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %s %s] /Resources << /Font << %s >> >> /Contents %d 0 R%s >>",
+			pagesObj, pdfNum(width), pdfNum(height), strings.Join(fontRes, " "), firstPage+2*i+1, annots))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+	info := obj(p.infoDict())
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(offsets)+1, catalog, info, xref)
+	return out.Bytes()
+}
+
+func (p *PDF) infoDict() string {
+	fields := []struct{ key, value string }{
+		{"Title", p.Info.Title},
+		{"Author", p.Info.Author},
+		{"Subject", p.Info.Subject},
+		{"Keywords", p.Info.Keywords},
+		{"Producer", "GoATPAD"},
+	}
+	var b strings.Builder
+	b.WriteString("<<")
+	for _, f := range fields {
+		if f.value != "" {
+			fmt.Fprintf(&b, " /%s %s", f.key, pdfTextString(f.value))
+		}
+	}
+	b.WriteString(" >>")
+	return b.String()
+}
+
+// Write document as PDF, wrapping paragraphs to the page width
+func savePDF(filename string, doc *Document) error {
+	p := &PDF{Info: doc.Props}
+	layoutDocument(p, doc)
+	return os.WriteFile(filename, p.Bytes(), 0644)
+}
+
+// A piece of a line: text in one font
+type pdfPiece struct {
+	text  string
+	font  string
+	size  float64
+	width float64
+	link  string
+}
+
+// Flow the paragraphs of doc onto pages of p
+func layoutDocument(p *PDF, doc *Document) {
+	p.AddPage()
+	y := pdfPageHeight - pdfMargin
+	maxWidth := pdfPageWidth - 2*pdfMargin
+	for _, para := range doc.Paragraphs() {
+		if para.PageBreak() {
+			p.AddPage()
+			y = pdfPageHeight - pdfMargin
+			continue
+		}
+		for _, line := range paragraphLines(para, maxWidth) {
+			height, width := lineSize(line)
+			if y-height < pdfMargin {
+				p.AddPage()
+				y = pdfPageHeight - pdfMargin
+			}
+			y -= height
+			x := pdfMargin
+			if para.Align() == "center" {
+				x += (maxWidth - width) / 2
+			}
+			drawLine(p, line, x, y, height)
+		}
+	}
+}
+
+// The lines of para wrapped to maxWidth; an empty paragraph is one
+// empty line
+func paragraphLines(para Paragraph, maxWidth float64) [][]pdfPiece {
+	var pieces []pdfPiece
+	for _, r := range para.Runs {
+		if r.Change != nil && r.Change.Kind == ChangeDelete {
+			continue
+		}
+		font, size := pdfRunFont(r)
+		for _, word := range splitWords(r.Text) {
+			pieces = append(pieces, pdfPiece{word, font, size, pdfTextWidth(word, font, size), r.Tags["link"]})
+		}
+	}
+	lines := wrapPieces(pieces, maxWidth)
+	if len(lines) == 0 {
+		lines = [][]pdfPiece{nil}
+	}
+	return lines
+}
+
+// Height of a line, with leading, and its width
+func lineSize(line []pdfPiece) (height, width float64) {
+	height = 12.0
+	for _, piece := range line {
+		if piece.size > height {
+			height = piece.size
+		}
+		width += piece.width
+	}
+	return height * 1.2, width
+}
+
+// Draw line with its baseline starting at x, y
+func drawLine(p *PDF, line []pdfPiece, x, y, height float64) {
+	// One link rectangle per run of pieces sharing a URL
+	linkStart := x
+	for i, piece := range line {
+		if strings.TrimSpace(piece.text) != "" {
+			p.Text(x, y, piece.font, piece.size, piece.text)
+		}
+		if i == 0 || line[i-1].link != piece.link {
+			linkStart = x
+		}
+		x += piece.width
+		if piece.link != "" && (i == len(line)-1 || line[i+1].link != piece.link) {
+			p.Link(linkStart, y-height*0.2, x, y+height*0.8, piece.link)
+		}
+	}
+}
+
+func pdfRunFont(r Run) (font string, size float64) {
+	_, bold := r.Tags["bold"]
+	_, italic := r.Tags["italic"]
+	switch {
+	case bold && italic:
+		font = "F4"
+	case bold:
+		font = "F2"
+	case italic:
+		font = "F3"
+	default:
+		font = "F1"
+	}
+	size = 12
+	if v, ok := r.Tags["size"]; ok {
+		if pt, err := strconv.ParseFloat(v, 64); err == nil {
+			size = pt
+		}
+	}
+	return font, size
+}
+
+// Split s into words, each followed by the spaces after it
+func splitWords(s string) []string {
+	var words []string
+	start := 0
+	for i := 1; i < len(s); i++ {
+		if s[i-1] == ' ' && s[i] != ' ' {
+			words = append(words, s[start:i])
+			start = i
+		}
+	}
+	if start < len(s) {
+		words = append(words, s[start:])
+	}
+	return words
+}
+
+// Greedy line breaking; trailing spaces do not count against the width
+func wrapPieces(pieces []pdfPiece, maxWidth float64) [][]pdfPiece {
+	var lines [][]pdfPiece
+	var line []pdfPiece
+	width := 0.0
+	for _, piece := range pieces {
+		trimmed := pdfTextWidth(strings.TrimRight(piece.text, " "), piece.font, piece.size)
+		if len(line) > 0 && width+trimmed > maxWidth && strings.HasSuffix(line[len(line)-1].text, " ") {
+			lines = append(lines, line)
+			line, width = nil, 0
+		}
+		line = append(line, piece)
+		width += piece.width
+	}
+	if len(line) > 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func pdfNum(f float64) string {
+	return strconv.FormatFloat(math.Round(f*100)/100, 'f', -1, 64)
+}
+
+// Literal string in WinAnsi encoding
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, c := range encodeCP1252(s) {
+		switch c {
+		case '(', ')', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			if c < 32 || c > 126 {
+				fmt.Fprintf(&b, "\\%03o", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Text string for the info dictionary, UTF-16 when not plain ASCII
+func pdfTextString(s string) string {
+	ascii := true
+	for _, r := range s {
+		if r > 126 {
+			ascii = false
+		}
+	}
+	if ascii {
+		return "(" + pdfEscape(s) + ")"
+	}
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	b.WriteString(">")
+	return b.String()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// MergePreview shows the template merged with one record at a time in
+// the text view. The merged text lives in its own read-only buffer, so
+// the template and its review state are untouched while previewing.
+type MergePreview struct {
+	ed       *Editor
+	db       *sql.DB
+	buffer   *gtk.TextBuffer
+	bar      *gtk.Box
+	label    *gtk.Label
+	warning  *gtk.Label
+	search   *gtk.SearchEntry
+	template *Document
+	tmpl     *MergeTemplate
+	notes    string
+	columns  []string
+	records  [][]string
+	index    int
+}
+
+func newMergePreview(builder *gtk.Builder, ed *Editor, db *sql.DB) *MergePreview {
+	buffer, err := gtk.TextBufferNew(ed.tagTable)
+	if err != nil {
+		log.Fatal("Unable to create buffer:", err)
+	}
+	p := &MergePreview{ed: ed, db: db, buffer: buffer}
+	barObj, err := builder.GetObject("preview_bar")
+	if err != nil {
+		log.Fatal("Failed to get preview bar:", err)
+	}
+	p.bar = barObj.(*gtk.Box)
+	labelObj, _ := builder.GetObject("preview_label")
+	p.label = labelObj.(*gtk.Label)
+	warningObj, _ := builder.GetObject("preview_warning")
+	p.warning = warningObj.(*gtk.Label)
+	searchObj, _ := builder.GetObject("preview_search")
+	p.search = searchObj.(*gtk.SearchEntry)
+
+	// Navigation
+	for id, step := range map[string]func() int{
+		"preview_first": func() int { return 0 },
+		"preview_prev":  func() int { return p.index - 1 },
+		"preview_next":  func() int { return p.index + 1 },
+		"preview_last":  func() int { return len(p.records) - 1 },
+	} {
+		step := step
+		btnObj, _ := builder.GetObject(id)
+		btnObj.(*gtk.Button).Connect("clicked", func() {
+			p.Show(step())
+		})
+	}
+	p.search.Connect("activate", func() {
+		query, err := p.search.GetText()
+		if err != nil {
+			log.Println("Get text error:", err)
+			return
+		}
+		p.Jump(query)
+	})
+	return p
+}
+
+// Start previewing the current template against the merge table.
+// Reports false, after saying why, if the records cannot be read.
+func (p *MergePreview) Start() bool {
+	table := p.ed.fields.Table
+	var columns []string
+	var records [][]string
+	var err error
+	if query := p.ed.fields.Query; query != "" {
+		columns, records, err = loadQueryRecords(p.db, query, Filter{})
+	} else {
+		var relations []Relation
+		if relations, err = savedRelations(p.db, table); err != nil {
+			log.Println("Relations error:", err)
+		}
+		columns, records, err = loadRecords(p.db, table, Filter{}, relations)
+	}
+	if err != nil {
+		log.Println("Query error:", err)
+		messageDialog(p.ed.window, "Error", "Unable to read table "+table+": "+err.Error())
+		return false
+	}
+	p.template = p.ed.Document().Slice(0, p.ed.buffer.GetCharCount())
+	p.columns, p.records = columns, records
+	var warnings []string
+	if len(records) == 0 {
+		warnings = append(warnings, "No records in "+table)
+	}
+	if unknown := p.ed.fields.Unknown(); len(unknown) > 0 {
+		warnings = append(warnings, "Unknown fields: {{"+strings.Join(unknown, "}}, {{")+"}}")
+	}
+	p.tmpl, err = newMergeTemplate(p.template, columns)
+	if err != nil {
+		warnings = append(warnings, "Template error: "+err.Error())
+	}
+	p.notes = strings.Join(warnings, "   ")
+	p.warning.SetText(p.notes)
+
+	p.ed.textView.SetBuffer(p.buffer)
+	p.ed.textView.SetEditable(false)
+	p.bar.SetNoShowAll(false)
+	p.bar.ShowAll()
+	p.Show(0)
+	return true
+}
+
+// Stop goes back to editing the template
+func (p *MergePreview) Stop() {
+	p.ed.textView.SetBuffer(p.ed.buffer)
+	p.ed.textView.SetEditable(!p.ed.readOnly)
+	p.bar.Hide()
+	p.records = nil
+}
+
+// Show record i (from 0), clamped to the records there are
+func (p *MergePreview) Show(i int) {
+	if len(p.records) == 0 {
+		p.index = 0
+		p.showDocument(p.template)
+		p.label.SetText("No records")
+		return
+	}
+	p.index = clamp(i, 0, len(p.records)-1)
+	p.warning.SetText(p.notes)
+	if p.tmpl == nil {
+		p.showDocument(p.template)
+	} else if doc, err := p.tmpl.Merge(p.columns, p.records[p.index]); err != nil {
+		p.showDocument(p.template)
+		p.warning.SetText("Template error: " + err.Error())
+	} else {
+		p.showDocument(doc)
+	}
+	p.label.SetText(fmt.Sprintf("Record %d of %d", p.index+1, len(p.records)))
+}
+
+// Put doc in the preview buffer with its formatting. Links show as
+// plain text; the preview is not for following them.
+func (p *MergePreview) showDocument(doc *Document) {
+	p.buffer.SetText(doc.Text)
+	for _, span := range doc.Tags {
+		if span.Tag == "link" {
+			continue
+		}
+		// The size tag is shared, so merged text takes the current size
+		if tag, err := p.ed.tagTable.Lookup(span.Tag); err == nil {
+			p.buffer.ApplyTag(tag, p.buffer.GetIterAtOffset(span.Start), p.buffer.GetIterAtOffset(span.End))
+		}
+	}
+}
+
+// Jump to a record number, or to the next record with a value
+// containing query
+func (p *MergePreview) Jump(query string) {
+	query = strings.TrimSpace(query)
+	if query == "" || len(p.records) == 0 {
+		return
+	}
+	if n, err := strconv.Atoi(query); err == nil {
+		p.Show(n - 1)
+		return
+	}
+	query = strings.ToLower(query)
+	for step := 1; step <= len(p.records); step++ {
+		i := (p.index + step) % len(p.records)
+		for _, value := range p.records[i] {
+			if strings.Contains(strings.ToLower(value), query) {
+				p.Show(i)
+				return
+			}
+		}
+	}
+	p.label.SetText("No match")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// Document properties dialog
+func propertiesDialog(parent *gtk.Window, ed *Editor) {
+	dialog, err := gtk.DialogNew()
+	if err != nil {
+		log.Fatal("Unable to create dialog:", err)
+	}
+	dialog.SetTitle("Document Properties")
+	dialog.SetTransientFor(parent)
+	dialog.SetModal(true)
+	dialog.AddButton("OK", gtk.RESPONSE_ACCEPT)
+	dialog.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+
+	vbox, err := dialog.GetContentArea()
+	if err != nil {
+		log.Fatal("Unable to get content area:", err)
+	}
+	grid, err := gtk.GridNew()
+	if err != nil {
+		log.Fatal("Unable to create grid:", err)
+	}
+	grid.SetRowSpacing(5)
+	grid.SetColumnSpacing(5)
+	vbox.PackStart(grid, true, true, 5)
+
+	// Title, author, subject, keywords
+	fields := []struct {
+		label string
+		value *string
+	}{
+		{"Title:", &ed.props.Title},
+		{"Author:", &ed.props.Author},
+		{"Subject:", &ed.props.Subject},
+		{"Keywords:", &ed.props.Keywords},
+	}
+	entries := make([]*gtk.Entry, len(fields))
+	for i, field := range fields {
+		label, err := gtk.LabelNew(field.label)
+		if err != nil {
+			log.Fatal("Unable to create label:", err)
+		}
+		label.SetXAlign(0)
+		entry, err := gtk.EntryNew()
+		if err != nil {
+			log.Fatal("Unable to create entry:", err)
+		}
+		entry.SetText(*field.value)
+		entry.SetHExpand(true)
+		grid.Attach(label, 0, i, 1, 1)
+		grid.Attach(entry, 1, i, 1, 1)
+		entries[i] = entry
+	}
+	entries[3].SetPlaceholderText("comma separated")
+
+	vbox.ShowAll()
+	if dialog.Run() == gtk.RESPONSE_ACCEPT {
+		for i, field := range fields {
+			text, err := entries[i].GetText()
+			if err != nil {
+				log.Fatal("Unable to get entry text:", err)
+			}
+			*field.value = text
+		}
+	}
+	dialog.Destroy()
+}
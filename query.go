@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The merge dialog's data source entry for a hand-written query
+const customQueryID = "query:"
+
+// What a custom query's records are called in errors and saved filters
+const customQueryName = "query"
+
+// checkQuery makes sure query is a single statement that only reads:
+// SELECT, WITH ... SELECT or VALUES. It returns query without the
+// trailing semicolon, ready for queryFrom.
+func checkQuery(query string) (string, error) {
+	// The query with quoted names and strings as x and comments as
+	// spaces, so neither hides a ; or a keyword
+	runes := []rune(query)
+	code := make([]rune, len(runes))
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		code[i] = c
+		switch {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			close := c
+			if c == '[' {
+				close = ']'
+			}
+			j := i + 1
+			for j < len(runes) && runes[j] != close {
+				j++
+			}
+			if j == len(runes) {
+				return "", fmt.Errorf("query: unterminated %c", c)
+			}
+			for ; i <= j; i++ {
+				code[i] = 'x'
+			}
+			i--
+		case c == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for ; i < len(runes) && runes[i] != '\n'; i++ {
+				code[i] = ' '
+			}
+			i--
+		case c == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			j := i + 2
+			for j+1 < len(runes) && !(runes[j] == '*' && runes[j+1] == '/') {
+				j++
+			}
+			if j+1 >= len(runes) {
+				return "", fmt.Errorf("query: unterminated comment")
+			}
+			for ; i <= j+1; i++ {
+				code[i] = ' '
+			}
+			i--
+		}
+	}
+	text := string(code)
+	end := len(runes)
+	if i := strings.IndexRune(text, ';'); i >= 0 {
+		if strings.Trim(text[i:], "; \t\r\n") != "" {
+			return "", fmt.Errorf("query: only one statement may be merged")
+		}
+		end = len([]rune(text[:i]))
+	}
+	word := strings.TrimLeft(text, " \t\r\n(")
+	if i := strings.IndexFunc(word, func(r rune) bool { return !unicode.IsLetter(r) }); i >= 0 {
+		word = word[:i]
+	}
+	switch strings.ToLower(word) {
+	case "select", "with", "values":
+	case "":
+		return "", fmt.Errorf("query: expected SELECT")
+	default:
+		return "", fmt.Errorf("query: only SELECT queries can be merged, not %s", strings.ToUpper(word))
+	}
+	return strings.TrimSpace(string(runes[:end])), nil
+}
+
+// queryFrom is query as a source for selectQuery. SQLite only takes a
+// SELECT as a subquery, so every read of it is read-only too. The
+// parenthesis closes on a line of its own in case query ends in a
+// comment.
+func queryFrom(query string) string {
+	return "(" + query + "\n)"
+}
+
+// queryColumns checks query and returns the names of its result
+// columns, without reading any rows
+func queryColumns(db *sql.DB, query string) ([]string, error) {
+	query, err := checkQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT * FROM " + queryFrom(query) + " LIMIT 0")
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+	return rows.Columns()
+}
+
+// loadQueryRecords is loadRecords for a custom query
+func loadQueryRecords(db *sql.DB, query string, filter Filter) ([]string, [][]string, error) {
+	query, err := checkQuery(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	selectSQL, args, err := selectQuery(queryFrom(query), filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	return readRecords(db, selectSQL, args...)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Relations are saved in the merge database, by parent table
+const relationsTable = "goatpad_relations"
+
+// How queries name the parent table, so a child table can relate to
+// its own kind
+const relationParent = "goatpad_parent"
+
+// Relation brings the child rows of each parent record into its merge:
+// the rows of Table whose ForeignKey matches the parent's Key, as a list
+// named Name for templates to loop over with {{range .Name}}
+type Relation struct {
+	Name       string    `json:"name"`
+	Table      string    `json:"table"`
+	ForeignKey string    `json:"foreign_key"`
+	Key        string    `json:"key"`
+	Sort       []SortKey `json:"sort,omitempty"`
+}
+
+// String writes r the way parseRelation reads it
+func (r Relation) String() string {
+	s := fmt.Sprintf("%s: %s.%s = %s", r.Name, r.Table, r.ForeignKey, r.Key)
+	if len(r.Sort) > 0 {
+		keys := make([]string, len(r.Sort))
+		for i, key := range r.Sort {
+			keys[i] = key.Column
+			if key.Desc {
+				keys[i] += " DESC"
+			}
+		}
+		s += " order by " + strings.Join(keys, ", ")
+	}
+	return s
+}
+
+// parseRelation reads a relation like
+// Items: invoice_lines.invoice_id = id order by line_no. The name
+// defaults to the child table.
+func parseRelation(spec string) (Relation, error) {
+	var r Relation
+	rest := spec
+	if name, link, ok := strings.Cut(spec, ":"); ok {
+		r.Name, rest = strings.TrimSpace(name), link
+	}
+	if i := strings.Index(strings.ToLower(rest), "order by"); i >= 0 {
+		sort, err := parseOrderBy(rest[i+len("order by"):])
+		if err != nil {
+			return r, fmt.Errorf("relation %q: %w", spec, err)
+		}
+		r.Sort, rest = sort, rest[:i]
+	}
+	child, key, ok := strings.Cut(strings.TrimRight(strings.TrimSpace(rest), ","), "=")
+	dot := strings.LastIndex(child, ".")
+	if !ok || dot < 0 {
+		return r, fmt.Errorf("relation %q: expected [NAME:] CHILD.FOREIGN_KEY = KEY", spec)
+	}
+	r.Table = strings.TrimSpace(child[:dot])
+	r.ForeignKey = strings.TrimSpace(child[dot+1:])
+	r.Key = strings.TrimSpace(key)
+	if r.Name == "" {
+		r.Name = r.Table
+	}
+	if r.Table == "" || r.ForeignKey == "" || r.Key == "" {
+		return r, fmt.Errorf("relation %q: expected [NAME:] CHILD.FOREIGN_KEY = KEY", spec)
+	}
+	return r, nil
+}
+
+// relationColumns checks relations against table and the database and
+// returns the columns that add them to a SELECT of table: each child
+// list as JSON in a column named like a JSON source's lists, so
+// mergeData hands templates a list of records.
+func relationColumns(db *sql.DB, table string, relations []Relation) ([]string, error) {
+	if len(relations) == 0 {
+		return nil, nil
+	}
+	parentCols, err := tableColumns(db, table)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, col := range parentCols {
+		names[col.Name] = true
+	}
+	var columns []string
+	for _, r := range relations {
+		if !names[r.Key] {
+			return nil, fmt.Errorf("relation %s: %s has no column %q", r.Name, table, r.Key)
+		}
+		if names[r.Name] || names[r.Name+jsonListSuffix] {
+			return nil, fmt.Errorf("relation %s: the name is already taken", r.Name)
+		}
+		names[r.Name+jsonListSuffix] = true
+		childCols, err := tableColumns(db, r.Table)
+		if err != nil {
+			return nil, err
+		}
+		if len(childCols) == 0 {
+			return nil, fmt.Errorf("relation %s: no table %q", r.Name, r.Table)
+		}
+		child := map[string]bool{}
+		var pairs []string
+		for _, col := range childCols {
+			child[col.Name] = true
+			pairs = append(pairs, "'"+strings.ReplaceAll(col.Name, "'", "''")+"', "+quoteIdent(col.Name))
+		}
+		if !child[r.ForeignKey] {
+			return nil, fmt.Errorf("relation %s: %s has no column %q", r.Name, r.Table, r.ForeignKey)
+		}
+		for _, key := range r.Sort {
+			if !child[key.Column] {
+				return nil, fmt.Errorf("relation %s: %s has no column %q to order by", r.Name, r.Table, key.Column)
+			}
+		}
+		rows := "SELECT * FROM " + quoteIdent(r.Table) + " WHERE " + quoteIdent(r.ForeignKey) + " = " + relationParent + "." + quoteIdent(r.Key)
+		if order := (Filter{Sort: r.Sort}).OrderBy(); order != "" {
+			rows += " ORDER BY " + order
+		}
+		columns = append(columns, "(SELECT json_group_array(json_object("+strings.Join(pairs, ", ")+")) FROM ("+rows+")) AS "+quoteIdent(r.Name+jsonListSuffix))
+	}
+	return columns, nil
+}
+
+func createRelationsTable(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + relationsTable + " (source TEXT, name TEXT, relation TEXT, PRIMARY KEY (source, name))")
+	return err
+}
+
+// Save r for table, replacing any relation of that name
+func saveRelation(db *sql.DB, table string, r Relation) error {
+	if err := createRelationsTable(db); err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO "+relationsTable+" (source, name, relation) VALUES (?, ?, ?)", table, r.Name, string(data))
+	return err
+}
+
+func deleteRelation(db *sql.DB, table, name string) error {
+	if err := createRelationsTable(db); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM "+relationsTable+" WHERE source = ? AND name = ?", table, name)
+	return err
+}
+
+// The relations saved for table, by name
+func savedRelations(db *sql.DB, table string) ([]Relation, error) {
+	if err := createRelationsTable(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT relation FROM "+relationsTable+" WHERE source = ? ORDER BY name", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var relations []Relation
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var r Relation
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return nil, err
+		}
+		relations = append(relations, r)
+	}
+	return relations, rows.Err()
+}
+
+// relationFlags collects --relation, which may be given more than once
+type relationFlags []Relation
+
+func (f *relationFlags) String() string {
+	specs := make([]string, len(*f))
+	for i, r := range *f {
+		specs[i] = r.String()
+	}
+	return strings.Join(specs, "; ")
+}
+
+func (f *relationFlags) Set(spec string) error {
+	r, err := parseRelation(spec)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+// Relations with extra put in place of any of the same name
+func withRelations(relations, extra []Relation) []Relation {
+	var out []Relation
+	for _, r := range relations {
+		replaced := false
+		for _, e := range extra {
+			replaced = replaced || e.Name == r.Name
+		}
+		if !replaced {
+			out = append(out, r)
+		}
+	}
+	return append(out, extra...)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// RelationEditor lists the relations saved for the merge source in the
+// mail merge dialog, and adds and removes them
+type RelationEditor struct {
+	Expander  *gtk.Expander
+	parent    *gtk.Window
+	db        *sql.DB
+	table     string
+	columns   []string
+	relations []Relation
+	list      *gtk.Box
+	rows      []*gtk.Box
+	name      *gtk.Entry
+	child     *gtk.ComboBoxText
+	foreign   *gtk.ComboBoxText
+	key       *gtk.ComboBoxText
+	order     *gtk.Entry
+	changed   func()
+}
+
+// changed is called whenever a relation is added or removed
+func newRelationEditor(parent *gtk.Window, db *sql.DB, changed func()) *RelationEditor {
+	e := &RelationEditor{parent: parent, db: db, changed: changed}
+	var err error
+	e.Expander, err = gtk.ExpanderNew("Related Rows")
+	if err != nil {
+		log.Fatal("Unable to create expander:", err)
+	}
+	e.Expander.SetTooltipText("Child rows of each record, for {{range .Name}}...{{end}}, {{count .Name}} and {{sum \"Amount\" .Name}}")
+	box, err := gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 5)
+	if err != nil {
+		log.Fatal("Unable to create box:", err)
+	}
+	e.list, err = gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 5)
+	if err != nil {
+		log.Fatal("Unable to create box:", err)
+	}
+	box.PackStart(e.list, false, false, 0)
+
+	// A new relation: Name: child.foreign = key order by ...
+	addBox, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
+	if err != nil {
+		log.Fatal("Unable to create box:", err)
+	}
+	e.name, err = gtk.EntryNew()
+	if err != nil {
+		log.Fatal("Unable to create entry:", err)
+	}
+	e.name.SetPlaceholderText("Name")
+	e.name.SetWidthChars(8)
+	e.child, err = gtk.ComboBoxTextNew()
+	if err != nil {
+		log.Fatal("Unable to create combo box:", err)
+	}
+	e.foreign, err = gtk.ComboBoxTextNew()
+	if err != nil {
+		log.Fatal("Unable to create combo box:", err)
+	}
+	equals, err := gtk.LabelNew("=")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	e.key, err = gtk.ComboBoxTextNew()
+	if err != nil {
+		log.Fatal("Unable to create combo box:", err)
+	}
+	e.order, err = gtk.EntryNew()
+	if err != nil {
+		log.Fatal("Unable to create entry:", err)
+	}
+	e.order.SetPlaceholderText("Order by")
+	e.order.SetWidthChars(8)
+	addButton, err := gtk.ButtonNewWithLabel("Add")
+	if err != nil {
+		log.Fatal("Unable to create button:", err)
+	}
+	addBox.PackStart(e.name, false, false, 0)
+	addBox.PackStart(e.child, false, false, 0)
+	addBox.PackStart(e.foreign, false, false, 0)
+	addBox.PackStart(equals, false, false, 0)
+	addBox.PackStart(e.key, false, false, 0)
+	addBox.PackStart(e.order, true, true, 0)
+	addBox.PackStart(addButton, false, false, 0)
+	box.PackStart(addBox, false, false, 0)
+	e.Expander.Add(box)
+
+	e.child.Connect("changed", e.childChanged)
+	addButton.Connect("clicked", e.add)
+	return e
+}
+
+// SetSource shows the relations saved for table. An empty table, for a
+// data file, has none.
+func (e *RelationEditor) SetSource(table string, columns []string) {
+	e.table, e.columns = table, columns
+	e.Expander.SetSensitive(table != "")
+	e.key.RemoveAll()
+	for _, col := range columns {
+		e.key.Append(col, col)
+	}
+	// Parents are usually keyed by id
+	e.key.SetActive(0)
+	for _, col := range columns {
+		if strings.EqualFold(col, "id") {
+			e.key.SetActiveID(col)
+		}
+	}
+	e.child.RemoveAll()
+	if table != "" {
+		sources, err := dataSources(e.db)
+		if err != nil {
+			log.Println("Table list error:", err)
+		}
+		for _, source := range sources {
+			if source.Name != table {
+				e.child.Append(source.Name, source.Label())
+			}
+		}
+	}
+	e.child.SetActive(0)
+	e.relations = nil
+	if table != "" {
+		var err error
+		if e.relations, err = savedRelations(e.db, table); err != nil {
+			log.Println("Relations error:", err)
+		}
+	}
+	e.refresh()
+}
+
+// Relations for the merge
+func (e *RelationEditor) Relations() []Relation {
+	return e.relations
+}
+
+// Offer the child table's columns as its foreign key, guessing one
+// named after the parent, like invoice_id for invoices
+func (e *RelationEditor) childChanged() {
+	e.foreign.RemoveAll()
+	child := e.child.GetActiveID()
+	if child == "" {
+		return
+	}
+	columns, err := tableColumns(e.db, child)
+	if err != nil {
+		log.Println("Table info error:", err)
+	}
+	guess := strings.TrimSuffix(strings.ToLower(e.table), "s") + "_id"
+	e.foreign.SetActive(-1)
+	for i, col := range columns {
+		e.foreign.Append(col.Name, col.Name)
+		if i == 0 || strings.EqualFold(col.Name, guess) {
+			e.foreign.SetActiveID(col.Name)
+		}
+	}
+	if name, _ := e.name.GetText(); name == "" {
+		e.name.SetPlaceholderText(child)
+	}
+}
+
+func (e *RelationEditor) add() {
+	r := Relation{
+		Table:      e.child.GetActiveID(),
+		ForeignKey: e.foreign.GetActiveID(),
+		Key:        e.key.GetActiveID(),
+	}
+	name, err := e.name.GetText()
+	if err != nil {
+		log.Fatal("Unable to get entry text:", err)
+	}
+	r.Name = strings.TrimSpace(name)
+	if r.Name == "" {
+		r.Name = r.Table
+	}
+	order, err := e.order.GetText()
+	if err != nil {
+		log.Fatal("Unable to get entry text:", err)
+	}
+	if r.Sort, err = parseOrderBy(order); err != nil {
+		messageDialog(e.parent, "Error", "Invalid order: "+err.Error())
+		return
+	}
+	if r.Table == "" || r.ForeignKey == "" || r.Key == "" {
+		messageDialog(e.parent, "Error", "Choose a child table, its foreign key and the key it matches")
+		return
+	}
+	relations := withRelations(e.relations, []Relation{r})
+	if _, err := relationColumns(e.db, e.table, relations); err != nil {
+		messageDialog(e.parent, "Error", "Invalid "+err.Error())
+		return
+	}
+	if err := saveRelation(e.db, e.table, r); err != nil {
+		log.Println("Save relation error:", err)
+		messageDialog(e.parent, "Error", "Unable to save relation: "+err.Error())
+		return
+	}
+	e.relations = relations
+	e.name.SetText("")
+	e.order.SetText("")
+	e.refresh()
+	e.changed()
+}
+
+// Rebuild the list of relations, each with a Remove button
+func (e *RelationEditor) refresh() {
+	for _, row := range e.rows {
+		row.Destroy()
+	}
+	e.rows = nil
+	for _, r := range e.relations {
+		r := r
+		row, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
+		if err != nil {
+			log.Fatal("Unable to create box:", err)
+		}
+		label, err := gtk.LabelNew(r.String())
+		if err != nil {
+			log.Fatal("Unable to create label:", err)
+		}
+		label.SetXAlign(0)
+		removeButton, err := gtk.ButtonNewFromIconName("list-remove", gtk.ICON_SIZE_BUTTON)
+		if err != nil {
+			log.Fatal("Unable to create button:", err)
+		}
+		row.PackStart(label, true, true, 0)
+		row.PackStart(removeButton, false, false, 0)
+		removeButton.Connect("clicked", func() {
+			if err := deleteRelation(e.db, e.table, r.Name); err != nil {
+				log.Println("Delete relation error:", err)
+				messageDialog(e.parent, "Error", "Unable to remove relation: "+err.Error())
+				return
+			}
+			for i, other := range e.relations {
+				if other.Name == r.Name {
+					e.relations = append(e.relations[:i:i], e.relations[i+1:]...)
+					break
+				}
+			}
+			e.refresh()
+			e.changed()
+		})
+		e.list.PackStart(row, false, false, 0)
+		row.ShowAll()
+		e.rows = append(e.rows, row)
+	}
+}
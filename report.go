@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gotk3/gotk3/glib"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// Written to the output folder unless --manifest says otherwise
+const defaultManifest = "manifest.csv"
+
+const (
+	statusOK        = "ok"
+	statusFailed    = "failed"
+	statusCancelled = "cancelled"
+	statusSkipped   = "skipped" // sent by an earlier run
+)
+
+// Batch exit codes
+const (
+	exitOK      = 0
+	exitFailed  = 1 // nothing merged, or the merge could not start
+	exitPartial = 2 // some records failed
+)
+
+// How one record of a merge went
+type RecordResult struct {
+	Record int    `json:"record"` // from 1, in merge order
+	Key    string `json:"key"`
+	Output string `json:"output"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (r RecordResult) Failed(err error) RecordResult {
+	r.Status = statusFailed
+	r.Error = err.Error()
+	return r
+}
+
+// Cancelled marks a record the merge stopped before writing
+func (r RecordResult) Cancelled() RecordResult {
+	r.Status = statusCancelled
+	r.Output = ""
+	return r
+}
+
+// Skipped marks a record an earlier run already sent, at when
+func (r RecordResult) Skipped(when string) RecordResult {
+	r.Status = statusSkipped
+	r.Error = "already sent " + when
+	return r
+}
+
+// MergeReport collects the results of one merge run
+type MergeReport struct {
+	Started   time.Time      `json:"started"`
+	Finished  time.Time      `json:"finished"`
+	Total     int            `json:"total"` // records matched, merged or not
+	Results   []RecordResult `json:"results"`
+	Err       string         `json:"error,omitempty"` // stopped part way
+	Cancelled bool           `json:"cancelled,omitempty"`
+	Manifest  string         `json:"-"`
+}
+
+// Finish puts the results in record order
+func (r *MergeReport) Finish() {
+	r.Finished = time.Now()
+	sort.Slice(r.Results, func(i, j int) bool {
+		return r.Results[i].Record < r.Results[j].Record
+	})
+}
+
+func (r *MergeReport) Counts() (ok, failed, cancelled int) {
+	for _, result := range r.Results {
+		switch result.Status {
+		case statusOK, statusSkipped:
+			ok++
+		case statusCancelled:
+			cancelled++
+		default:
+			failed++
+		}
+	}
+	return ok, failed, cancelled
+}
+
+// Summary is one line for the log or a dialog
+func (r *MergeReport) Summary() string {
+	ok, failed, cancelled := r.Counts()
+	summary := fmt.Sprintf("Merged %d of %d records in %s", ok, max(r.Total, len(r.Results)),
+		r.Finished.Sub(r.Started).Round(time.Millisecond))
+	if failed > 0 {
+		summary += fmt.Sprintf(", %d failed", failed)
+	}
+	if r.Err != "" {
+		summary += "; stopped early: " + r.Err
+	}
+	if r.Cancelled {
+		summary += fmt.Sprintf("; cancelled, %d not written", max(r.Total-ok-failed, cancelled))
+	}
+	return summary
+}
+
+func (r *MergeReport) ExitCode() int {
+	ok, failed, _ := r.Counts()
+	switch {
+	case ok == 0 && (failed > 0 || r.Err != "" || r.Cancelled):
+		return exitFailed
+	case failed > 0 || r.Err != "" || r.Cancelled:
+		return exitPartial
+	}
+	return exitOK
+}
+
+// WriteManifest saves the results as JSON if path ends in .json, or
+// else as CSV
+func (r *MergeReport) WriteManifest(path string) error {
+	var data []byte
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var err error
+		if data, err = json.MarshalIndent(r, "", "  "); err != nil {
+			return err
+		}
+	} else {
+		var b strings.Builder
+		w := csv.NewWriter(&b)
+		w.Write([]string{"record", "key", "output", "status", "error"})
+		for _, result := range r.Results {
+			w.Write([]string{strconv.Itoa(result.Record), result.Key, result.Output, result.Status, result.Error})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+		data = []byte(b.String())
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// A short name for a record in reports: its id, else its Name, else its
+// first column, else its number
+func recordKey(columns, values []string, n int) string {
+	for _, want := range []string{"id", "name"} {
+		for i, col := range columns {
+			if strings.EqualFold(col, want) && values[i] != "" {
+				return values[i]
+			}
+		}
+	}
+	if len(values) > 0 && values[0] != "" {
+		return values[0]
+	}
+	return strconv.Itoa(n)
+}
+
+// Show how a merge went, record by record, with the option to save the
+// manifest elsewhere
+func mergeResultsDialog(parent *gtk.Window, report *MergeReport) {
+	dialog, err := gtk.DialogNew()
+	if err != nil {
+		log.Fatal("Unable to create dialog:", err)
+	}
+	dialog.SetTitle("Mail Merge Results")
+	dialog.SetTransientFor(parent)
+	dialog.SetModal(true)
+	dialog.SetDefaultSize(500, 300)
+	dialog.AddButton("Save Manifest...", gtk.RESPONSE_APPLY)
+	dialog.AddButton("Close", gtk.RESPONSE_CLOSE)
+
+	vbox, err := dialog.GetContentArea()
+	if err != nil {
+		log.Fatal("Unable to get content area:", err)
+	}
+	summary := report.Summary()
+	if report.Manifest != "" {
+		summary += "\nManifest: " + report.Manifest
+	}
+	label, err := gtk.LabelNew(summary)
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	label.SetXAlign(0)
+	label.SetSelectable(true)
+	vbox.PackStart(label, false, false, 5)
+
+	titles := []string{"Record", "Key", "Output", "Status", "Error"}
+	types := make([]glib.Type, len(titles))
+	for i := range types {
+		types[i] = glib.TYPE_STRING
+	}
+	store, err := gtk.ListStoreNew(types...)
+	if err != nil {
+		log.Fatal("Unable to create list store:", err)
+	}
+	for _, result := range report.Results {
+		iter := store.Append()
+		for i, val := range []string{strconv.Itoa(result.Record), result.Key, filepath.Base(result.Output), result.Status, result.Error} {
+			store.SetValue(iter, i, val)
+		}
+	}
+	treeView, err := gtk.TreeViewNewWithModel(store)
+	if err != nil {
+		log.Fatal("Unable to create tree view:", err)
+	}
+	for i, title := range titles {
+		renderer, err := gtk.CellRendererTextNew()
+		if err != nil {
+			log.Fatal("Unable to create cell renderer:", err)
+		}
+		column, err := gtk.TreeViewColumnNewWithAttribute(title, renderer, "text", i)
+		if err != nil {
+			log.Fatal("Unable to create tree view column:", err)
+		}
+		column.SetResizable(true)
+		treeView.AppendColumn(column)
+	}
+	scrolled, err := gtk.ScrolledWindowNew(nil, nil)
+	if err != nil {
+		log.Fatal("Unable to create scrolled window:", err)
+	}
+	scrolled.SetPolicy(gtk.POLICY_AUTOMATIC, gtk.POLICY_AUTOMATIC)
+	scrolled.Add(treeView)
+	vbox.PackStart(scrolled, true, true, 5)
+	vbox.ShowAll()
+
+	for dialog.Run() == gtk.RESPONSE_APPLY {
+		saveDialog, err := gtk.FileChooserDialogNewWith2Buttons(
+			"Save Manifest", parent, gtk.FILE_CHOOSER_ACTION_SAVE,
+			"Cancel", gtk.RESPONSE_CANCEL,
+			"Save", gtk.RESPONSE_ACCEPT,
+		)
+		if err != nil {
+			log.Fatal("Unable to create file chooser dialog:", err)
+		}
+		saveDialog.SetDoOverwriteConfirmation(true)
+		saveDialog.SetCurrentName("manifest.json")
+		if saveDialog.Run() == gtk.RESPONSE_ACCEPT {
+			filename := saveDialog.GetFilename()
+			if err := report.WriteManifest(filename); err != nil {
+				log.Println("Manifest error:", err)
+				messageDialog(parent, "Error", "Unable to save manifest: "+err.Error())
+			}
+		}
+		saveDialog.Destroy()
+	}
+	dialog.Destroy()
+}
+
+// Run a merge in the background behind a progress dialog with elapsed
+// time, an estimate of the time left and a Cancel button
+func runMergeWithProgress(parent *gtk.Window, db *sql.DB, job MergeJob) (*MergeReport, error) {
+	dialog, err := gtk.DialogNew()
+	if err != nil {
+		log.Fatal("Unable to create dialog:", err)
+	}
+	dialog.SetTitle("Mail Merge")
+	dialog.SetTransientFor(parent)
+	dialog.SetModal(true)
+	dialog.SetDefaultSize(400, -1)
+	dialog.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+	vbox, err := dialog.GetContentArea()
+	if err != nil {
+		log.Fatal("Unable to get content area:", err)
+	}
+	bar, err := gtk.ProgressBarNew()
+	if err != nil {
+		log.Fatal("Unable to create progress bar:", err)
+	}
+	bar.SetShowText(true)
+	bar.SetText("Starting...")
+	timeLabel, err := gtk.LabelNew("")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	timeLabel.SetXAlign(0)
+	vbox.PackStart(bar, false, false, 10)
+	vbox.PackStart(timeLabel, false, false, 5)
+	vbox.ShowAll()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	progress := &MergeProgress{}
+	started := time.Now()
+	finished := false
+	var report *MergeReport
+	go func() {
+		report, err = mailMerge(ctx, db, job, progress)
+		glib.IdleAdd(func() bool {
+			finished = true
+			dialog.Destroy()
+			return false
+		})
+	}()
+	glib.TimeoutAdd(200, func() bool {
+		if finished {
+			return false
+		}
+		done, total := progress.Done.Load(), progress.Total.Load()
+		elapsed := time.Since(started)
+		text := "Elapsed " + formatDuration(elapsed)
+		if total > 0 {
+			bar.SetFraction(float64(done) / float64(total))
+			bar.SetText(fmt.Sprintf("%d of %d records", done, total))
+			if done > 0 && ctx.Err() == nil {
+				left := time.Duration(float64(elapsed) / float64(done) * float64(total-done))
+				text += ", about " + formatDuration(left) + " left"
+			}
+		}
+		if ctx.Err() != nil {
+			text += ", cancelling..."
+		}
+		timeLabel.SetText(text)
+		return true
+	})
+
+	// Cancel or closing the dialog stops the merge; the dialog goes once
+	// the workers have finished
+	for !finished {
+		dialog.Run()
+		if !finished {
+			cancel()
+			dialog.SetResponseSensitive(gtk.RESPONSE_CANCEL, false)
+		}
+	}
+	return report, err
+}
+
+// m:ss, or h:mm:ss for an hour or more
+func formatDuration(d time.Duration) string {
+	secs := int(d.Round(time.Second).Seconds())
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
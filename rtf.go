@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Write document as RTF with character formatting, alignment and links.
+// Pending deletions are left out.
+func saveRTF(filename string, doc *Document) error {
+	return os.WriteFile(filename, []byte(documentRTF(doc)), 0644)
+}
+
+func documentRTF(doc *Document) string {
+	var b strings.Builder
+	b.WriteString("{\\rtf1\\ansi\\deff0{\\fonttbl{\\f0 Arial;}}{\\colortbl;\\red0\\green0\\blue238;}\n")
+	b.WriteString("{\\info")
+	for _, field := range []struct{ key, value string }{
+		{"title", doc.Props.Title},
+		{"author", doc.Props.Author},
+		{"subject", doc.Props.Subject},
+		{"keywords", doc.Props.Keywords},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(&b, "{\\%s %s}", field.key, rtfEscape(field.value))
+		}
+	}
+	b.WriteString("}\\fs24\n")
+	afterBreak := false
+	for i, p := range doc.Paragraphs() {
+		if i > 0 && !afterBreak {
+			b.WriteString("\\par\n")
+		}
+		// The page break opens the next paragraph rather than leaving an
+		// empty one at the top of the page
+		afterBreak = p.PageBreak()
+		if afterBreak {
+			b.WriteString("\\page\n")
+			continue
+		}
+		if p.Align() == "center" {
+			b.WriteString("\\pard\\qc ")
+		} else {
+			b.WriteString("\\pard\\ql ")
+		}
+		for _, r := range p.Runs {
+			if r.Change != nil && r.Change.Kind == ChangeDelete {
+				continue
+			}
+			b.WriteString(rtfRun(r))
+		}
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func rtfRun(r Run) string {
+	var ctrl strings.Builder
+	if _, ok := r.Tags["bold"]; ok {
+		ctrl.WriteString("\\b")
+	}
+	if _, ok := r.Tags["italic"]; ok {
+		ctrl.WriteString("\\i")
+	}
+	if size, ok := r.Tags["size"]; ok {
+		// \fs is in half-points
+		if pt, err := strconv.ParseFloat(size, 64); err == nil {
+			fmt.Fprintf(&ctrl, "\\fs%d", int(pt*2))
+		}
+	}
+	url, isLink := r.Tags["link"]
+	if isLink {
+		ctrl.WriteString("\\ul\\cf1")
+	}
+	if ctrl.Len() > 0 {
+		ctrl.WriteByte(' ')
+	}
+	run := "{" + ctrl.String() + rtfEscape(r.Text) + "}"
+	if isLink {
+		// A quote would end the instruction's string and a space splits it
+		url = strings.NewReplacer(`"`, "%22", " ", "%20").Replace(url)
+		run = fmt.Sprintf("{\\field{\\*\\fldinst{HYPERLINK \"%s\"}}{\\fldrslt%s}}", rtfEscape(url), run)
+	}
+	return run
+}
+
+// Escape RTF specials; non-ASCII becomes \uN? in UTF-16 units
+func rtfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '{' || r == '}':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString("\\tab ")
+		case r < 0x80:
+			b.WriteRune(r)
+		default:
+			for _, u := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&b, "\\u%d?", int16(u))
+			}
+		}
+	}
+	return b.String()
+}
+
+// Destinations whose content is not document text
+var rtfSkipped = map[string]bool{
+	"fonttbl": true, "colortbl": true, "stylesheet": true, "info": true, "pict": true,
+	"object": true, "header": true, "headerl": true, "headerr": true, "footer": true,
+	"footerl": true, "footerr": true, "listtable": true, "listoverridetable": true,
+	"rsidtbl": true, "generator": true, "themedata": true, "colorschememapping": true,
+	"datastore": true, "latentstyles": true, "xmlnstbl": true, "footnote": true,
+}
+
+// Characters written as control words
+var rtfSymbols = map[string]rune{
+	"tab": '\t', "emdash": '—', "endash": '–', "bullet": '•', "lquote": '‘',
+	"rquote": '’', "ldblquote": '“', "rdblquote": '”', "cell": '\t',
+}
+
+// Formatting in effect inside an RTF group
+type rtfState struct {
+	bold, italic bool
+	size         string
+	link         string
+	center       bool
+	skip         bool
+	instr        *strings.Builder // field instruction being read
+	uc           int              // fallback characters after \u
+}
+
+// parseRTF reads an RTF document, as word processors put on the
+// clipboard, into text with bold, italic, size, center and link tags.
+// Pictures, tables and other destinations are skipped.
+func parseRTF(s string) *Document {
+	type charFormat struct {
+		bold, italic bool
+		size, link   string
+	}
+	var out []rune
+	var formats []charFormat
+	var centered [][2]int
+	paraStart := 0
+	state := rtfState{uc: 1}
+	var stack []rtfState
+	skipChars := 0 // fallback characters still to drop after \u
+	var high rune  // pending UTF-16 high surrogate
+
+	emit := func(r rune) {
+		if skipChars > 0 {
+			skipChars--
+			return
+		}
+		if state.skip {
+			return
+		}
+		if state.instr != nil {
+			state.instr.WriteRune(r)
+			return
+		}
+		out = append(out, r)
+		formats = append(formats, charFormat{state.bold, state.italic, state.size, state.link})
+	}
+	endParagraph := func() {
+		if state.center && paraStart < len(out) {
+			centered = append(centered, [2]int{paraStart, len(out)})
+		}
+		emit('\n')
+		paraStart = len(out)
+	}
+
+	ignorable := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '{':
+			stack = append(stack, state)
+		case '}':
+			if len(stack) == 0 {
+				continue
+			}
+			link := ""
+			if state.instr != nil && stack[len(stack)-1].instr == nil {
+				link = rtfHyperlink(state.instr.String())
+			}
+			state = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if link != "" {
+				state.link = link
+			}
+		case '\r', '\n':
+		case '\\':
+			if i+1 >= len(s) {
+				break
+			}
+			i++
+			c = s[i]
+			switch {
+			case c == '\'' && i+2 < len(s):
+				if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+					emit(cp1252Rune(byte(b)))
+				}
+				i += 2
+			case c == '\\' || c == '{' || c == '}':
+				emit(rune(c))
+			case c == '~':
+				emit(' ')
+			case c == '_':
+				emit('-')
+			case c == '*':
+				ignorable = true
+				continue
+			case c == '\r' || c == '\n':
+				endParagraph()
+			case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+				j := i
+				for j < len(s) && (s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z') {
+					j++
+				}
+				word := s[i:j]
+				k := j
+				if k < len(s) && s[k] == '-' {
+					k++
+				}
+				for k < len(s) && s[k] >= '0' && s[k] <= '9' {
+					k++
+				}
+				param, hasParam := 0, false
+				if k > j {
+					param, _ = strconv.Atoi(s[j:k])
+					hasParam = true
+				}
+				if k < len(s) && s[k] == ' ' {
+					k++
+				}
+				i = k - 1
+
+				switch {
+				case word == "fldinst":
+					state.instr = &strings.Builder{}
+				case rtfSkipped[word] || ignorable:
+					state.skip = true
+				case word == "b":
+					state.bold = !hasParam || param != 0
+				case word == "i":
+					state.italic = !hasParam || param != 0
+				case word == "fs" && hasParam:
+					// 12 pt is the editor's normal size, not a size tag
+					state.size = ""
+					if param != 24 {
+						state.size = strconv.FormatFloat(float64(param)/2, 'f', -1, 64)
+					}
+				case word == "plain":
+					state.bold, state.italic, state.size = false, false, ""
+				case word == "pard":
+					state.center = false
+				case word == "qc":
+					state.center = true
+				case word == "ql" || word == "qr" || word == "qj":
+					state.center = false
+				case word == "par" || word == "line" || word == "row" || word == "sect" || word == "page":
+					endParagraph()
+				case word == "uc" && hasParam:
+					state.uc = param
+				case word == "u" && hasParam:
+					r := rune(param)
+					if r < 0 {
+						r += 0x10000
+					}
+					switch {
+					case utf16.IsSurrogate(r) && r < 0xDC00:
+						high = r
+					case high != 0:
+						emit(utf16.DecodeRune(high, r))
+						high = 0
+					default:
+						emit(r)
+					}
+					skipChars = state.uc
+				default:
+					if r, ok := rtfSymbols[word]; ok {
+						emit(r)
+					}
+				}
+			}
+			ignorable = false
+		default:
+			emit(cp1252Rune(c))
+		}
+	}
+	if state.center && paraStart < len(out) {
+		centered = append(centered, [2]int{paraStart, len(out)})
+	}
+
+	// Trailing paragraph marks are not text
+	for len(out) > 0 && out[len(out)-1] == '\n' {
+		out = out[:len(out)-1]
+	}
+	doc := &Document{Text: string(out)}
+	span := func(tag, value string, start, end int) {
+		if start < end {
+			doc.Tags = append(doc.Tags, TagSpan{Tag: tag, Start: start, End: end, Value: value})
+		}
+	}
+	// Turn per-character formatting into spans
+	starts := map[string]int{}
+	values := map[string]string{}
+	for i := 0; i <= len(out); i++ {
+		current := map[string]string{}
+		if i < len(out) {
+			f := formats[i]
+			if f.bold {
+				current["bold"] = ""
+			}
+			if f.italic {
+				current["italic"] = ""
+			}
+			if f.size != "" {
+				current["size"] = f.size
+			}
+			if f.link != "" {
+				current["link"] = f.link
+			}
+		}
+		for tag, value := range values {
+			if v, ok := current[tag]; !ok || v != value {
+				span(tag, value, starts[tag], i)
+				delete(values, tag)
+			}
+		}
+		for tag, value := range current {
+			if _, ok := values[tag]; !ok {
+				starts[tag], values[tag] = i, value
+			}
+		}
+	}
+	for _, r := range centered {
+		span("center", "", r[0], min(r[1], len(out)))
+	}
+	sort.Slice(doc.Tags, func(i, j int) bool { return doc.Tags[i].Start < doc.Tags[j].Start })
+	return doc
+}
+
+// URL of a HYPERLINK field instruction
+func rtfHyperlink(instr string) string {
+	fields := strings.Fields(instr)
+	if len(fields) < 2 || fields[0] != "HYPERLINK" {
+		return ""
+	}
+	return strings.Trim(fields[1], `"`)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Quote an SQLite identifier so table and column names need no escaping
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// A table or view that can feed a mail merge
+type DataSource struct {
+	Name string
+	View bool
+}
+
+// Tables and views in the database, by name
+func dataSources(db *sql.DB) ([]DataSource, error) {
+	rows, err := db.Query("SELECT name, type FROM sqlite_master WHERE type IN ('table', 'view') AND name NOT LIKE 'sqlite_%' AND name NOT IN (?, ?, ?) ORDER BY name",
+		savedFiltersTable, deliveriesTable, relationsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sources []DataSource
+	for rows.Next() {
+		var name, kind string
+		if err := rows.Scan(&name, &kind); err != nil {
+			return nil, err
+		}
+		sources = append(sources, DataSource{Name: name, View: kind == "view"})
+	}
+	return sources, rows.Err()
+}
+
+// Label for a source in menus and lists
+func (s DataSource) Label() string {
+	if s.View {
+		return s.Name + " (view)"
+	}
+	return s.Name
+}
+
+// Columns of table from PRAGMA table_info
+func tableColumns(db *sql.DB, table string) ([]Column, error) {
+	rows, err := db.Query("PRAGMA table_info(" + quoteIdent(table) + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []Column
+	for rows.Next() {
+		var cid int
+		var name, colType string
+		var notnull, pk int
+		var dflt_value *string
+		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt_value, &pk); err != nil {
+			return nil, err
+		}
+		columns = append(columns, Column{Name: name, Type: colType})
+	}
+	return columns, rows.Err()
+}
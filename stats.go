@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/gotk3/gotk3/glib"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+type TextStats struct {
+	Words         int
+	Chars         int
+	CharsNoSpaces int
+	Paragraphs    int // non-blank lines
+	Lines         int
+}
+
+func textStats(text string) TextStats {
+	stats := TextStats{Words: len(strings.Fields(text)), Lines: strings.Count(text, "\n") + 1}
+	for _, r := range text {
+		stats.Chars++
+		if !unicode.IsSpace(r) {
+			stats.CharsNoSpaces++
+		}
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) != "" {
+			stats.Paragraphs++
+		}
+	}
+	return stats
+}
+
+func (s TextStats) String() string {
+	return fmt.Sprintf("Words: %d   Characters: %d (%d without spaces)   Paragraphs: %d   Lines: %d",
+		s.Words, s.Chars, s.CharsNoSpaces, s.Paragraphs, s.Lines)
+}
+
+// Keep the status bar in step with the buffer: counts shortly after
+// changes stop (not while a file is still loading), cursor position
+// whenever the insert mark moves.
+func setupStatusBar(ed *Editor, statusBar *gtk.Statusbar) {
+	buffer := ed.buffer
+	contextID := statusBar.GetContextId("stats")
+	stats := ""
+	update := func() {
+		cursor := buffer.GetIterAtMark(buffer.GetInsert())
+		mode := ""
+		if ed.readOnly {
+			mode = "   Read-only"
+		}
+		statusBar.RemoveAll(contextID)
+		statusBar.Push(contextID, fmt.Sprintf("%s   Ln %d, Col %d%s",
+			stats, cursor.GetLine()+1, cursor.GetLineOffset()+1, mode))
+	}
+	pending := false
+	buffer.Connect("changed", func() {
+		if pending {
+			return
+		}
+		pending = true
+		glib.TimeoutAdd(250, func() bool {
+			if ed.loading {
+				return true
+			}
+			pending = false
+			start, end := buffer.GetBounds()
+			text, err := buffer.GetText(start, end, false)
+			if err != nil {
+				log.Println("Get text error:", err)
+				return false
+			}
+			stats = textStats(text).String()
+			update()
+			return false
+		})
+	})
+	buffer.Connect("mark-set", func(_ *gtk.TextBuffer, _ *gtk.TextIter, mark *gtk.TextMark) {
+		if mark.GetName() == "insert" {
+			update()
+		}
+	})
+	stats = textStats("").String()
+	update()
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"log"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gotk3/gotk3/glib"
+	"github.com/gotk3/gotk3/gtk"
+	"github.com/gotk3/gotk3/pango"
+)
+
+// Colors handed out to reviewers in order of appearance
+var authorColors = []string{"#0000C0", "#C00000", "#008000", "#8000A0", "#A06000"}
+
+// Tracker records insertions and deletions while track changes is on.
+// Each change owns a text tag; the tag ranges are the change's extent, so
+// they move with the text as it is edited.
+type Tracker struct {
+	buffer   *gtk.TextBuffer
+	tagTable *gtk.TextTagTable
+	Enabled  bool
+	Author   string
+	changes  map[int]*Change
+	tags     map[int]*gtk.TextTag
+	authors  []string
+	last     *Change
+	nextID   int
+	busy     bool // set while the tracker edits the buffer itself
+}
+
+func newTracker(buffer *gtk.TextBuffer, tagTable *gtk.TextTagTable) *Tracker {
+	t := &Tracker{
+		buffer:   buffer,
+		tagTable: tagTable,
+		Author:   defaultAuthor(),
+		changes:  map[int]*Change{},
+		tags:     map[int]*gtk.TextTag{},
+		nextID:   1,
+	}
+	buffer.ConnectAfter("insert-text", t.onInsertText)
+	buffer.Connect("delete-range", t.onDeleteRange)
+	return t
+}
+
+func defaultAuthor() string {
+	u, err := user.Current()
+	if err != nil || u.Username == "" {
+		return "GoATPAD"
+	}
+	return u.Username
+}
+
+// Runs after the default handler, so iter sits at the end of the new text
+func (t *Tracker) onInsertText(buf *gtk.TextBuffer, iter *gtk.TextIter, text string) {
+	if !t.Enabled || t.busy {
+		return
+	}
+	end := iter.GetOffset()
+	start := end - utf8.RuneCountInString(text)
+	change := t.last
+	if change == nil || change.Kind != ChangeInsert || change.Author != t.Author ||
+		start == 0 || !buf.GetIterAtOffset(start-1).HasTag(t.tags[change.ID]) {
+		change = t.newChange(ChangeInsert)
+	}
+	buf.ApplyTag(t.tags[change.ID], buf.GetIterAtOffset(start), buf.GetIterAtOffset(end))
+}
+
+// Runs before the default handler. Text that is itself a pending insertion
+// is removed for real; anything else is struck through instead of deleted.
+func (t *Tracker) onDeleteRange(buf *gtk.TextBuffer, start, end *gtk.TextIter) {
+	if !t.Enabled || t.busy {
+		return
+	}
+	buf.StopEmission("delete-range")
+	from, to := start.GetOffset(), end.GetOffset()
+	cursor := buf.GetIterAtMark(buf.GetInsert()).GetOffset()
+
+	t.busy = true
+	defer func() { t.busy = false }()
+
+	var strike, remove [][2]int
+	for off := from; off < to; {
+		kind := t.kindAt(buf.GetIterAtOffset(off))
+		next := off + 1
+		for next < to && t.kindAt(buf.GetIterAtOffset(next)) == kind {
+			next++
+		}
+		switch kind {
+		case "":
+			strike = append(strike, [2]int{off, next})
+		case ChangeInsert:
+			remove = append(remove, [2]int{off, next})
+		}
+		off = next
+	}
+
+	if len(strike) > 0 {
+		change := t.last
+		if change == nil || change.Kind != ChangeDelete || change.Author != t.Author ||
+			!t.touches(change, from, to) {
+			change = t.newChange(ChangeDelete)
+		}
+		for _, r := range strike {
+			buf.ApplyTag(t.tags[change.ID], buf.GetIterAtOffset(r[0]), buf.GetIterAtOffset(r[1]))
+		}
+	}
+	removed := 0
+	for i := len(remove) - 1; i >= 0; i-- {
+		buf.Delete(buf.GetIterAtOffset(remove[i][0]), buf.GetIterAtOffset(remove[i][1]))
+		removed += remove[i][1] - remove[i][0]
+	}
+	t.prune()
+
+	// Forward delete steps over the struck text, backspace stays in front of it
+	if cursor == from {
+		buf.PlaceCursor(buf.GetIterAtOffset(to - removed))
+	} else {
+		buf.PlaceCursor(buf.GetIterAtOffset(from))
+	}
+}
+
+// Kind of the tracked change covering iter, or "" for untracked text
+func (t *Tracker) kindAt(iter *gtk.TextIter) string {
+	for id, tag := range t.tags {
+		if iter.HasTag(tag) {
+			return t.changes[id].Kind
+		}
+	}
+	return ""
+}
+
+// Whether change is adjacent to the range from..to
+func (t *Tracker) touches(change *Change, from, to int) bool {
+	tag := t.tags[change.ID]
+	if from > 0 && t.buffer.GetIterAtOffset(from-1).HasTag(tag) {
+		return true
+	}
+	return t.buffer.GetIterAtOffset(to).HasTag(tag)
+}
+
+func (t *Tracker) newChange(kind string) *Change {
+	change := &Change{ID: t.nextID, Kind: kind, Author: t.Author, Time: time.Now()}
+	t.nextID++
+	t.addChange(change)
+	t.last = change
+	return change
+}
+
+func (t *Tracker) addChange(change *Change) {
+	tag, err := gtk.TextTagNew("change-" + strconv.Itoa(change.ID))
+	if err != nil {
+		log.Println("Create tag error:", err)
+		return
+	}
+	color := t.authorColor(change.Author)
+	tag.SetProperty("foreground", color)
+	if change.Kind == ChangeInsert {
+		tag.SetProperty("underline", pango.UNDERLINE_SINGLE)
+	} else {
+		tag.SetProperty("strikethrough", true)
+	}
+	t.tagTable.Add(tag)
+	t.changes[change.ID] = change
+	t.tags[change.ID] = tag
+	if change.ID >= t.nextID {
+		t.nextID = change.ID + 1
+	}
+}
+
+func (t *Tracker) authorColor(author string) string {
+	for i, a := range t.authors {
+		if a == author {
+			return authorColors[i%len(authorColors)]
+		}
+	}
+	t.authors = append(t.authors, author)
+	return authorColors[(len(t.authors)-1)%len(authorColors)]
+}
+
+// Drop changes whose text has gone entirely
+func (t *Tracker) prune() {
+	for id, tag := range t.tags {
+		if len(tagRanges(t.buffer, tag)) == 0 {
+			t.removeChange(id)
+		}
+	}
+}
+
+func (t *Tracker) removeChange(id int) {
+	if tag, ok := t.tags[id]; ok {
+		start, end := t.buffer.GetBounds()
+		t.buffer.RemoveTag(tag, start, end)
+		t.tagTable.Remove(tag)
+	}
+	if t.last != nil && t.last.ID == id {
+		t.last = nil
+	}
+	delete(t.tags, id)
+	delete(t.changes, id)
+}
+
+// Changes returns the pending changes with their current extents, one
+// entry per contiguous range, ordered by position.
+func (t *Tracker) Changes() []Change {
+	var out []Change
+	for id, tag := range t.tags {
+		for _, r := range tagRanges(t.buffer, tag) {
+			c := *t.changes[id]
+			c.Start, c.End = r[0], r[1]
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start < out[j].Start })
+	return out
+}
+
+// Restore re-creates the changes of a loaded document
+func (t *Tracker) Restore(changes []Change) {
+	for i := range changes {
+		c := changes[i]
+		if _, ok := t.changes[c.ID]; !ok {
+			t.addChange(&c)
+		}
+		t.buffer.ApplyTag(t.tags[c.ID], t.buffer.GetIterAtOffset(c.Start), t.buffer.GetIterAtOffset(c.End))
+	}
+}
+
+// Reset forgets every change without touching the text
+func (t *Tracker) Reset() {
+	for id := range t.tags {
+		t.removeChange(id)
+	}
+	t.nextID = 1
+}
+
+// Accept keeps an insertion or applies a deletion
+func (t *Tracker) Accept(id int) {
+	t.resolve(id, ChangeDelete)
+}
+
+// Reject removes an insertion or restores deleted text
+func (t *Tracker) Reject(id int) {
+	t.resolve(id, ChangeInsert)
+}
+
+// Resolve a change; text of the given kind is deleted, the other kind
+// simply loses its markup.
+func (t *Tracker) resolve(id int, deleteKind string) {
+	change, ok := t.changes[id]
+	if !ok {
+		return
+	}
+	if change.Kind == deleteKind {
+		t.busy = true
+		ranges := tagRanges(t.buffer, t.tags[id])
+		for i := len(ranges) - 1; i >= 0; i-- {
+			t.buffer.Delete(t.buffer.GetIterAtOffset(ranges[i][0]), t.buffer.GetIterAtOffset(ranges[i][1]))
+		}
+		t.busy = false
+	}
+	t.removeChange(id)
+}
+
+func (t *Tracker) AcceptAll() {
+	for id := range t.changes {
+		t.Accept(id)
+	}
+}
+
+func (t *Tracker) RejectAll() {
+	for id := range t.changes {
+		t.Reject(id)
+	}
+}
+
+// Review dialog responses
+const (
+	responseAccept gtk.ResponseType = iota + 1
+	responseReject
+	responseAcceptAll
+	responseRejectAll
+)
+
+// Review changes dialog
+func reviewDialog(parent *gtk.Window, ed *Editor) {
+	t := ed.tracker
+	dialog, err := gtk.DialogNew()
+	if err != nil {
+		log.Fatal("Unable to create dialog:", err)
+	}
+	dialog.SetTitle("Review Changes")
+	dialog.SetTransientFor(parent)
+	dialog.SetModal(true)
+	dialog.SetDefaultSize(500, 300)
+	dialog.AddButton("Accept", responseAccept)
+	dialog.AddButton("Reject", responseReject)
+	dialog.AddButton("Accept All", responseAcceptAll)
+	dialog.AddButton("Reject All", responseRejectAll)
+	dialog.AddButton("Close", gtk.RESPONSE_CLOSE)
+
+	vbox, err := dialog.GetContentArea()
+	if err != nil {
+		log.Fatal("Unable to get content area:", err)
+	}
+
+	// Author
+	authorBox, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
+	if err != nil {
+		log.Fatal("Unable to create box:", err)
+	}
+	authorLabel, err := gtk.LabelNew("Author:")
+	if err != nil {
+		log.Fatal("Unable to create label:", err)
+	}
+	authorEntry, err := gtk.EntryNew()
+	if err != nil {
+		log.Fatal("Unable to create entry:", err)
+	}
+	authorEntry.SetText(t.Author)
+	authorEntry.Connect("changed", func() {
+		if author, err := authorEntry.GetText(); err == nil && author != "" {
+			t.Author = author
+		}
+	})
+	authorBox.PackStart(authorLabel, false, false, 5)
+	authorBox.PackStart(authorEntry, true, true, 5)
+	vbox.PackStart(authorBox, false, false, 5)
+
+	// Change list: ID, type, author, time, text
+	store, err := gtk.ListStoreNew(glib.TYPE_INT, glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING)
+	if err != nil {
+		log.Fatal("Unable to create list store:", err)
+	}
+	treeView, err := gtk.TreeViewNewWithModel(store)
+	if err != nil {
+		log.Fatal("Unable to create tree view:", err)
+	}
+	for i, title := range []string{"Type", "Author", "Time", "Text"} {
+		renderer, err := gtk.CellRendererTextNew()
+		if err != nil {
+			log.Fatal("Unable to create cell renderer:", err)
+		}
+		column, err := gtk.TreeViewColumnNewWithAttribute(title, renderer, "text", i+1)
+		if err != nil {
+			log.Fatal("Unable to create tree view column:", err)
+		}
+		treeView.AppendColumn(column)
+	}
+	scrolled, err := gtk.ScrolledWindowNew(nil, nil)
+	if err != nil {
+		log.Fatal("Unable to create scrolled window:", err)
+	}
+	scrolled.SetPolicy(gtk.POLICY_AUTOMATIC, gtk.POLICY_AUTOMATIC)
+	scrolled.Add(treeView)
+	vbox.PackStart(scrolled, true, true, 5)
+
+	refresh := func() {
+		store.Clear()
+		for _, c := range t.Changes() {
+			start := ed.buffer.GetIterAtOffset(c.Start)
+			end := ed.buffer.GetIterAtOffset(c.End)
+			text := strings.ReplaceAll(start.GetText(end), "\n", " ")
+			if utf8.RuneCountInString(text) > 40 {
+				text = string([]rune(text)[:40]) + "..."
+			}
+			iter := store.Append()
+			store.Set(iter, []int{0, 1, 2, 3, 4},
+				[]interface{}{c.ID, c.Kind, c.Author, c.Time.Format("2006-01-02 15:04"), text})
+		}
+	}
+	selectedID := func() (int, bool) {
+		selection, err := treeView.GetSelection()
+		if err != nil {
+			return 0, false
+		}
+		_, iter, ok := selection.GetSelected()
+		if !ok {
+			return 0, false
+		}
+		val, err := store.GetValue(iter, 0)
+		if err != nil {
+			return 0, false
+		}
+		id, err := val.GoValue()
+		if err != nil {
+			return 0, false
+		}
+		return id.(int), true
+	}
+
+	// Show the selected change in the editor
+	selection, err := treeView.GetSelection()
+	if err != nil {
+		log.Fatal("Unable to get selection:", err)
+	}
+	selection.Connect("changed", func() {
+		id, ok := selectedID()
+		if !ok {
+			return
+		}
+		if ranges := tagRanges(ed.buffer, t.tags[id]); len(ranges) > 0 {
+			start := ed.buffer.GetIterAtOffset(ranges[0][0])
+			ed.buffer.SelectRange(start, ed.buffer.GetIterAtOffset(ranges[0][1]))
+			ed.textView.ScrollToIter(start, 0.1, false, 0, 0)
+		}
+	})
+
+	refresh()
+	vbox.ShowAll()
+	for {
+		response := dialog.Run()
+		switch response {
+		case responseAccept, responseReject:
+			id, ok := selectedID()
+			if !ok {
+				messageDialog(parent, "Error", "Select a change first")
+				continue
+			}
+			if response == responseAccept {
+				t.Accept(id)
+			} else {
+				t.Reject(id)
+			}
+		case responseAcceptAll:
+			t.AcceptAll()
+		case responseRejectAll:
+			t.RejectAll()
+		default:
+			dialog.Destroy()
+			return
+		}
+		refresh()
+	}
+}